@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/codegangsta/cli"
+)
+
+// Outcomes of audit records.
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+// AuditRecord is an entry of the audit bucket appended by every mutating
+// operation.
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	OSUser string    `json:"osUser"`
+	// CorrelationID is the one on the log lines of the invocation.
+	CorrelationID string            `json:"cid,omitempty"`
+	Operation     string            `json:"operation"`
+	App           string            `json:"app,omitempty"`
+	Gateway       string            `json:"gateway,omitempty"`
+	Target        string            `json:"target,omitempty"`
+	Params        map[string]string `json:"params,omitempty"`
+	Outcome       string            `json:"outcome"`
+	Error         string            `json:"error,omitempty"`
+	// IDs are the ids of Kii Cloud and Gateway Agent related to the
+	// operation, e.g. gatewayID, thingID or commandID.
+	IDs map[string]string `json:"ids,omitempty"`
+}
+
+// auditor builds the audit record of an operation.
+type auditor struct {
+	rec AuditRecord
+}
+
+// startAudit starts the audit record of the operation. Flags set to the
+// command are recorded as parameters with secrets redacted.
+func startAudit(c *cli.Context, operation string) *auditor {
+	appName := appNameOf(c)
+	gatewayName, _ := resolveGateway(c)
+	a := &auditor{rec: AuditRecord{
+		Time:          time.Now(),
+		OSUser:        osUser(),
+		CorrelationID: correlationID,
+		Operation:     operation,
+		App:           appName,
+		Gateway:       gatewayName,
+		Params:        map[string]string{},
+		IDs:           map[string]string{},
+	}}
+	stepStarted(operation)
+	for _, name := range c.FlagNames() {
+		if !c.IsSet(name) {
+			continue
+		}
+		if secretFlagNames[name] {
+			a.rec.Params[name] = redacted
+		} else {
+			a.rec.Params[name] = c.String(name)
+		}
+	}
+	if id := storedGatewayID(gatewayKeyOf(appName, gatewayName)); id != "" {
+		a.rec.IDs["gatewayID"] = id
+	}
+	return a
+}
+
+func osUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// Target sets the target of the operation, e.g. vendor thing id of the
+// end-node.
+func (a *auditor) Target(target string) {
+	a.rec.Target = target
+}
+
+// ID records an id related to the operation.
+func (a *auditor) ID(name string, value string) {
+	if value != "" {
+		a.rec.IDs[name] = value
+	}
+}
+
+// Done stores the record as success.
+func (a *auditor) Done() {
+	a.rec.Outcome = outcomeSuccess
+	a.store()
+	stepCompleted(strings.TrimSpace(a.rec.Operation + " " + a.rec.Target))
+}
+
+// Fail stores the record as failure. The message is formatted by fmt.Sprint,
+// so operands are given with their own separators.
+func (a *auditor) Fail(v ...interface{}) {
+	a.rec.Outcome = outcomeFailure
+	a.rec.Error = strings.TrimSpace(fmt.Sprint(v...))
+	a.store()
+	stepFailed()
+}
+
+// Fatal stores the record as failure and exits in the same manner as
+// stdLog.Fatalln with the message stored.
+func (a *auditor) Fatal(v ...interface{}) {
+	a.Fail(v...)
+	stdLog.Fatalln(a.rec.Error)
+}
+
+func (a *auditor) store() {
+	j, err := json.Marshal(a.rec)
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("audit"))
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			return b.Put(auditKey(seq), j)
+		})
+	}
+	if err != nil {
+		stdLog.Warnln("failed to store audit record: ", err)
+	}
+}
+
+// auditKey encodes seq in big endian to keep records in order.
+func auditKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// auditFilter selects audit records. Empty fields match any record.
+type auditFilter struct {
+	App       string
+	Operation string
+	Target    string
+	Outcome   string
+	Since     time.Time
+}
+
+func (f auditFilter) match(r AuditRecord) bool {
+	return (f.App == "" || f.App == r.App) &&
+		(f.Operation == "" || f.Operation == r.Operation) &&
+		(f.Target == "" || f.Target == r.Target) &&
+		(f.Outcome == "" || f.Outcome == r.Outcome) &&
+		!r.Time.Before(f.Since)
+}
+
+// queryAudit returns the latest limit records matching f in chronological
+// order. limit <= 0 returns all.
+func queryAudit(f auditFilter, limit int) ([]AuditRecord, error) {
+	var records []AuditRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("audit")).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var r AuditRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if !f.match(r) {
+				continue
+			}
+			records = append(records, r)
+			if 0 < limit && limit <= len(records) {
+				break
+			}
+		}
+		return nil
+	})
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, err
+}
+
+// parseSince parses either a duration before now or RFC3339 time.
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// formatMap formats m as "k=v" pairs in sorted order.
+func formatMap(m map[string]string) string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := ""
+	for i, k := range keys {
+		if i > 0 {
+			s += " "
+		}
+		s += k + "=" + m[k]
+	}
+	return s
+}
+
+var history = cli.Command{
+	Name:      "history",
+	Usage:     "history [--app <app name>] [--operation <operation>] [--target <target>] [--outcome success|failure] [--since <duration or RFC3339>] [--limit <n>] [--json]",
+	UsageText: "Show the audit records of mutating operations.",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "app",
+			Usage: "Show records of the app",
+		},
+		cli.StringFlag{
+			Name:  "operation",
+			Usage: "Show records of the operation, e.g. onboard-node",
+		},
+		cli.StringFlag{
+			Name:  "target",
+			Usage: "Show records of the target, e.g. vendor thing id of the end-node",
+		},
+		cli.StringFlag{
+			Name:  "outcome",
+			Usage: "Show records of the outcome. success or failure",
+		},
+		cli.StringFlag{
+			Name:  "since",
+			Usage: "Show records since the time. Duration before now such as 24h or RFC3339 time",
+		},
+		cli.IntFlag{
+			Name:  "limit",
+			Value: 50,
+			Usage: "Show the latest n records. 0 shows all",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print records in JSON",
+		},
+	},
+	Action: func(c *cli.Context) {
+		since, err := parseSince(c.String("since"))
+		if err != nil {
+			stdLog.Fatalln("invalid since: ", err)
+		}
+		f := auditFilter{
+			App:       c.String("app"),
+			Operation: c.String("operation"),
+			Target:    c.String("target"),
+			Outcome:   c.String("outcome"),
+			Since:     since,
+		}
+		records, err := queryAudit(f, c.Int("limit"))
+		if err != nil {
+			stdLog.Fatalln("failed to read audit records: ", err)
+		}
+		if c.Bool("json") {
+			b, _ := json.MarshalIndent(records, "", "  ")
+			fmt.Println(string(b))
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tUSER\tOPERATION\tAPP\tGATEWAY\tTARGET\tOUTCOME\tIDS\tPARAMS")
+		for _, r := range records {
+			outcome := r.Outcome
+			if r.Error != "" {
+				outcome += ": " + r.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Format(time.RFC3339), r.OSUser,
+				r.Operation, r.App, r.Gateway, r.Target, outcome, formatMap(r.IDs), formatMap(r.Params))
+		}
+		w.Flush()
+	},
+}
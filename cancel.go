@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// gCtx is the context of the command. It is canceled by SIGINT or --timeout.
+var gCtx = context.Background()
+
+// progress is the steps of the command reported when it is canceled.
+var progress struct {
+	sync.Mutex
+	completed []string
+	running   string
+}
+
+// stepStarted records the step in progress.
+func stepStarted(name string) {
+	progress.Lock()
+	defer progress.Unlock()
+	progress.running = name
+}
+
+// stepCompleted records the step completed. name may differ from the one
+// given to stepStarted to tell the target.
+func stepCompleted(name string) {
+	progress.Lock()
+	defer progress.Unlock()
+	progress.completed = append(progress.completed, name)
+	progress.running = ""
+}
+
+// stepFailed clears the step in progress.
+func stepFailed() {
+	progress.Lock()
+	defer progress.Unlock()
+	progress.running = ""
+}
+
+func resetProgress() {
+	progress.Lock()
+	defer progress.Unlock()
+	progress.completed = nil
+	progress.running = ""
+}
+
+func printProgress() {
+	progress.Lock()
+	defer progress.Unlock()
+	if len(progress.completed) == 0 {
+		stdLog.Println("no step is completed.")
+	} else {
+		stdLog.Println("completed steps:", strings.Join(progress.completed, ", "))
+	}
+	if progress.running != "" {
+		stdLog.Warnln("stopped during", progress.running+". it may be partially applied.")
+	}
+}
+
+// startCancellation makes gCtx canceled on SIGINT or after timeout when it
+// is positive. The steps completed are printed before canceling. A second
+// SIGINT exits immediately.
+func startCancellation(timeout time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	gCtx = ctx
+	fd := int(os.Stdin.Fd())
+	state, _ := terminal.GetState(fd)
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	go func() {
+		select {
+		case <-sig:
+			stdLog.Warnln("interrupted. canceling requests in flight.")
+		case <-expired:
+			stdLog.Warnf("timed out after %v. canceling requests in flight.\n", timeout)
+		}
+		printProgress()
+		cancel()
+		<-sig
+		if state != nil {
+			terminal.Restore(fd, state)
+		}
+		os.Exit(130)
+	}()
+}
+
+// startLineCancellation makes gCtx canceled on SIGINT or after timeout
+// during a command of the shell. The returned func stops watching when the
+// command returns, and the shell goes on.
+func startLineCancellation(timeout time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	gCtx = ctx
+	resetProgress()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sig:
+			stdLog.Warnln("interrupted. canceling requests in flight.")
+		case <-expired:
+			stdLog.Warnf("timed out after %v. canceling requests in flight.\n", timeout)
+		case <-done:
+			return
+		}
+		printProgress()
+		cancel()
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(done)
+		cancel()
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Interaction is a request and response pair stored in a cassette directory,
+// one file per interaction. Secrets are redacted in both bodies.
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// matchKey returns the key to match a request with a recorded one: method,
+// path, sorted query and the normalized body. Host and headers are ignored
+// so that a cassette can be replayed against other addresses and tokens.
+func matchKey(method string, rawURL string, body []byte) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return method + " " + rawURL + "\n" + normalizeBody(body)
+	}
+	path := u.Path
+	if q := u.Query(); len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return method + " " + path + "\n" + normalizeBody(body)
+}
+
+// normalizeBody returns a JSON body with sorted keys and secrets redacted,
+// other bodies with surrounding spaces trimmed.
+func normalizeBody(b []byte) string {
+	return strings.TrimSpace(redactBody(bytes.TrimSpace(b)))
+}
+
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+func recordedResponse(req *http.Request, r RecordedResponse) *http.Response {
+	h := http.Header{}
+	for k, v := range r.Headers {
+		h.Set(k, v)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(strings.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// recordTransport writes interactions with next into dir. Files are numbered
+// after the existing ones, so several commands of a script can be recorded
+// into the same directory.
+type recordTransport struct {
+	next http.RoundTripper
+	dir  string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newRecordTransport(next http.RoundTripper, dir string) (*recordTransport, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	return &recordTransport{next: next, dir: dir, seq: len(files)}, nil
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resBody, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(resBody))
+
+	i := Interaction{
+		Request: RecordedRequest{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Body:   normalizeBody(reqBody),
+		},
+		Response: RecordedResponse{
+			Status:  res.StatusCode,
+			Headers: map[string]string{},
+			Body:    redactBody(resBody),
+		},
+	}
+	for k := range res.Header {
+		if !secretHeaders[http.CanonicalHeaderKey(k)] {
+			i.Response.Headers[k] = res.Header.Get(k)
+		}
+	}
+	b, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	name := fmt.Sprintf("%04d-%s%s", t.seq, req.Method, unsafeChars.ReplaceAllString(req.URL.Path, "_"))
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	err = ioutil.WriteFile(filepath.Join(t.dir, name+".json"), b, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record interaction: %v", err)
+	}
+	return res, nil
+}
+
+// replayTransport serves the interactions recorded in a directory without
+// sending anything. Each recorded interaction is served once in the recorded
+// order. When all of the matching ones are served, the last one is served
+// again, e.g. for polling.
+type replayTransport struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	keys         []string
+	used         []bool
+}
+
+func newReplayTransport(dir string) (*replayTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no interaction is recorded in %s", dir)
+	}
+	sort.Strings(files)
+	t := &replayTransport{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var i Interaction
+		err = json.Unmarshal(b, &i)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		t.interactions = append(t.interactions, i)
+		t.keys = append(t.keys, matchKey(i.Request.Method, i.Request.URL, []byte(i.Request.Body)))
+		t.used = append(t.used, false)
+	}
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	key := matchKey(req.Method, req.URL.String(), body)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last := -1
+	for i, k := range t.keys {
+		if k != key {
+			continue
+		}
+		if !t.used[i] {
+			t.used[i] = true
+			return recordedResponse(req, t.interactions[i].Response), nil
+		}
+		last = i
+	}
+	if last < 0 {
+		return nil, fmt.Errorf("no recorded interaction matches %s %s", req.Method, req.URL.Path)
+	}
+	return recordedResponse(req, t.interactions[last].Response), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMatchKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  [3]string
+		match bool
+	}{
+		{
+			name:  "host is ignored",
+			a:     [3]string{"GET", "http://192.168.0.10:4001/jp/token", ""},
+			b:     [3]string{"GET", "http://localhost:4001/jp/token", ""},
+			match: true,
+		},
+		{
+			name:  "query is sorted",
+			a:     [3]string{"GET", "http://h/things?b=2&a=1", ""},
+			b:     [3]string{"GET", "http://h/things?a=1&b=2", ""},
+			match: true,
+		},
+		{
+			name:  "json keys are sorted and secrets redacted",
+			a:     [3]string{"POST", "http://h/jp/token", `{"username":"admin","password":"p1"}`},
+			b:     [3]string{"POST", "http://h/jp/token", ` {"password":"p2", "username":"admin"}`},
+			match: true,
+		},
+		{
+			name: "method differs",
+			a:    [3]string{"GET", "http://h/things", ""},
+			b:    [3]string{"PUT", "http://h/things", ""},
+		},
+		{
+			name: "body differs",
+			a:    [3]string{"PUT", "http://h/things", `{"thingID":"th-1"}`},
+			b:    [3]string{"PUT", "http://h/things", `{"thingID":"th-2"}`},
+		},
+	}
+	for _, tt := range tests {
+		a := matchKey(tt.a[0], tt.a[1], []byte(tt.a[2]))
+		b := matchKey(tt.b[0], tt.b[1], []byte(tt.b[2]))
+		if (a == b) != tt.match {
+			t.Errorf("%s: matchKey() = %q and %q, want match %v", tt.name, a, b, tt.match)
+		}
+	}
+}
+
+// TestReplay replays auth and list-pending-nodes polled three times against
+// another address than the recorded one.
+func TestReplay(t *testing.T) {
+	rt, err := newReplayTransport("testdata/cassettes/list-pending-nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(t http.RoundTripper) { http.DefaultTransport = t }(http.DefaultTransport)
+	http.DefaultTransport = rt
+
+	ctx := context.Background()
+	addr := GatewayAddress{Host: "127.0.0.1", Port: 4001}
+	app := App{ID: "app1", Key: "key1", Site: "jp"}
+	token, err := localAuth(ctx, addr, app, "admin", "another password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != redacted {
+		t.Errorf("token = %q, want %q", token, redacted)
+	}
+	for i, want := range [][]string{{"N1", "N2"}, {"N2"}, {"N2"}} {
+		vids, err := _listPendingNodes(ctx, addr, app, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vids, want) {
+			t.Errorf("list %d: vids = %v, want %v", i+1, vids, want)
+		}
+	}
+	if _, err := _listOnboardedNodes(ctx, addr, app, token); err == nil {
+		t.Error("a request not recorded is served")
+	}
+}
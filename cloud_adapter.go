@@ -1,11 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/KiiPlatform/kii_go"
 )
 
+// CloudError is returned when Kii Cloud responds with an error status.
+type CloudError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *CloudError) Error() string {
+	return fmt.Sprintf("Kii Cloud responded %d: %s", e.StatusCode, e.Body)
+}
+
 func location(app App) string {
 	if len(app.Host) > 0 {
 		return app.Host
@@ -13,7 +31,63 @@ func location(app App) string {
 	return app.Site
 }
 
-func _updateVID(app App, user User, currentID string, newVID string, password string) error {
+// cloudURL returns the url of Kii Cloud REST API of the app.
+func cloudURL(app App, path string) string {
+	host := app.Host
+	if host == "" {
+		host = knownSites[app.Site]
+	}
+	return fmt.Sprintf("https://%s/api/apps/%s%s", host, app.ID, path)
+}
+
+// thingIFURL returns the url of Thing-IF REST API of the app.
+func thingIFURL(app App, path string) string {
+	host := app.Host
+	if host == "" {
+		host = knownSites[app.Site]
+	}
+	return fmt.Sprintf("https://%s/thing-if/apps/%s%s", host, app.ID, path)
+}
+
+// _cloudRequest calls Kii Cloud REST API which kii_go doesn't provide.
+func _cloudRequest(ctx context.Context, app App, token string, method string, u string, contentType string, body []byte) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := newRequest(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("X-Kii-AppID", app.ID)
+	req.Header.Add("X-Kii-AppKey", app.Key)
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || 400 <= res.StatusCode {
+		return b, &CloudError{StatusCode: res.StatusCode, Body: string(b)}
+	}
+	return b, nil
+}
+
+func _updateVID(ctx context.Context, app App, user User, currentID string, newVID string, password string) (err error) {
+	defer observe(targetCloud, "update-vendor-thing-id", time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	author := kii.APIAuthor{
 		App: kii.App{
 			AppID:    app.ID,
@@ -29,7 +103,11 @@ func _updateVID(app App, user User, currentID string, newVID string, password st
 	return author.UpdateVendorThingID(currentID, req)
 }
 
-func _postCommand(app App, user User, nodeID string, command []byte) (resp *kii.PostCommandResponse, err error) {
+func _postCommand(ctx context.Context, app App, user User, nodeID string, command []byte) (resp *kii.PostCommandResponse, err error) {
+	defer observe(targetCloud, "post-command", time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	author := kii.APIAuthor{
 		App: kii.App{
 			AppID:    app.ID,
@@ -46,10 +124,18 @@ func _postCommand(app App, user User, nodeID string, command []byte) (resp *kii.
 	if err != nil {
 		return
 	}
-	return author.PostCommand(nodeID, req)
+	resp, err = author.PostCommand(nodeID, req)
+	if err == nil {
+		commandsPosted.WithLabelValues(appLabel(app)).Inc()
+	}
+	return
 }
 
-func _postTraitCommand(app App, user User, nodeID string, command []byte) (resp *kii.PostCommandResponse, err error) {
+func _postTraitCommand(ctx context.Context, app App, user User, nodeID string, command []byte) (resp *kii.PostCommandResponse, err error) {
+	defer observe(targetCloud, "post-trait-command", time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	author := kii.APIAuthor{
 		App: kii.App{
 			AppID:    app.ID,
@@ -66,10 +152,18 @@ func _postTraitCommand(app App, user User, nodeID string, command []byte) (resp
 	if err != nil {
 		return
 	}
-	return author.PostTraitCommand(nodeID, req)
+	resp, err = author.PostTraitCommand(nodeID, req)
+	if err == nil {
+		commandsPosted.WithLabelValues(appLabel(app)).Inc()
+	}
+	return
 }
 
-func _onboardNode(app App, user User, gatewayID string, nodeVID string, nodePass string, thingType string, firmwareVersion string) (string, error) {
+func _onboardNode(ctx context.Context, app App, user User, gatewayID string, nodeVID string, nodePass string, thingType string, firmwareVersion string) (nodeID string, err error) {
+	defer observe(targetCloud, "onboard-end-node", time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	author := kii.APIAuthor{
 		App: kii.App{
 			AppID:    app.ID,
@@ -88,15 +182,19 @@ func _onboardNode(app App, user User, gatewayID string, nodeVID string, nodePass
 			EndNodeFirmwareVersion: firmwareVersion,
 		},
 	}
+	defer func() { onboardingsTotal.WithLabelValues("end-node", outcome(err)).Inc() }()
 	resp, err := author.OnboardEndnodeWithGatewayThingID(req)
 	if err != nil {
 		return "", err
 	}
-	nodeID := resp.EndNodeThingID
-	return nodeID, err
+	return resp.EndNodeThingID, nil
 }
 
-func _userLogin(app App, username string, password string) (id string, token string, err error) {
+func _userLogin(ctx context.Context, app App, username string, password string) (id string, token string, err error) {
+	defer observe(targetCloud, "user-login", time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
 	author := kii.APIAuthor{
 		App: kii.App{
 			AppID:    app.ID,
@@ -104,25 +202,81 @@ func _userLogin(app App, username string, password string) (id string, token str
 			Location: location(app),
 		},
 	}
-	req := kii.UserRegisterRequest{
-		LoginName: username,
-		Password:  password,
-	}
-	author.RegisterKiiUser(req)
-	req2 := kii.UserLoginRequest{
+	req := kii.UserLoginRequest{
 		UserName: username,
 		Password: password,
 	}
-	resp, err := author.LoginAsKiiUser(req2)
+	resp, err := author.LoginAsKiiUser(req)
 	if err != nil {
 		return
 	}
 	id = resp.ID
 	token = resp.AccessToken
+	if resp.ExpiresIn > 0 {
+		tokenExpiry.WithLabelValues(appLabel(app), "user").Set(float64(time.Now().Unix() + int64(resp.ExpiresIn)))
+	}
 	return
 }
 
-func _addOwner(app App, userID string, userToken string, gatewayID string, gatewayPassword string) error {
+// _revokeToken revokes the access token of the user.
+func _revokeToken(ctx context.Context, app App, token string) (err error) {
+	defer observe(targetCloud, "revoke-token", time.Now(), &err)
+	body, err := json.Marshal(map[string]string{"token": token})
+	if err != nil {
+		return err
+	}
+	_, err = _cloudRequest(ctx, app, token, "POST", cloudURL(app, "/oauth2/revoke"), "application/json", body)
+	return err
+}
+
+// UserConflictError is returned by _registerUser when a user with the same
+// login name, email address or phone number exists.
+type UserConflictError struct {
+	Field string
+	Value string
+}
+
+func (e *UserConflictError) Error() string {
+	if e.Field == "" {
+		return "the user already exists"
+	}
+	return fmt.Sprintf("a user with %s %s already exists", e.Field, e.Value)
+}
+
+// _registerUser registers the Kii user and returns its id.
+func _registerUser(ctx context.Context, app App, r UserRegistration, password string) (id string, err error) {
+	defer observe(targetCloud, "user-register", time.Now(), &err)
+	body, err := json.Marshal(struct {
+		UserRegistration
+		Password string `json:"password"`
+	}{r, password})
+	if err != nil {
+		return "", err
+	}
+	b, err := _cloudRequest(ctx, app, "", "POST", cloudURL(app, "/users"), "application/vnd.kii.RegistrationRequest+json", body)
+	if e, ok := err.(*CloudError); ok && e.StatusCode == 409 {
+		var resp struct {
+			Field string `json:"field"`
+			Value string `json:"value"`
+		}
+		json.Unmarshal(b, &resp)
+		return "", &UserConflictError{Field: resp.Field, Value: resp.Value}
+	}
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		UserID string `json:"userID"`
+	}
+	err = json.Unmarshal(b, &resp)
+	return resp.UserID, err
+}
+
+func _addOwner(ctx context.Context, app App, userID string, userToken string, gatewayID string, gatewayPassword string) (err error) {
+	defer observe(targetCloud, "add-owner", time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	author := kii.APIAuthor{
 		App: kii.App{
 			AppID:    app.ID,
@@ -136,6 +290,185 @@ func _addOwner(app App, userID string, userToken string, gatewayID string, gatew
 		ThingPassword: gatewayPassword,
 		Owner:         "user:" + userID,
 	}
-	_, err := author.OnboardThingByOwner(req3)
+	_, err = author.OnboardThingByOwner(req3)
 	return err
 }
+
+func _removeOwner(ctx context.Context, app App, user User, thingID string, owner string) (err error) {
+	defer observe(targetCloud, "remove-owner", time.Now(), &err)
+	u := cloudURL(app, "/things/"+thingID+"/ownership/"+owner)
+	_, err = _cloudRequest(ctx, app, user.Token, "DELETE", u, "", nil)
+	return err
+}
+
+// _listOwners returns the owners of the thing as user:<user id> and
+// group:<group id>.
+func _listOwners(ctx context.Context, app App, user User, thingID string) (owners []string, err error) {
+	defer observe(targetCloud, "list-owners", time.Now(), &err)
+	b, err := _cloudRequest(ctx, app, user.Token, "GET", cloudURL(app, "/things/"+thingID+"/ownership"), "", nil)
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+	var resp struct {
+		Users  []string `json:"users"`
+		Groups []string `json:"groups"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, err
+	}
+	for _, id := range resp.Users {
+		owners = append(owners, "user:"+id)
+	}
+	for _, id := range resp.Groups {
+		owners = append(owners, "group:"+id)
+	}
+	return owners, nil
+}
+
+// _addThingOwner adds the owner, user:<user id> or group:<group id>, to the
+// thing. The user must be an owner of the thing. It succeeds when the owner
+// is already an owner.
+func _addThingOwner(ctx context.Context, app App, user User, thingID string, owner string) (err error) {
+	defer observe(targetCloud, "add-thing-owner", time.Now(), &err)
+	u := cloudURL(app, "/things/"+thingID+"/ownership/"+owner)
+	_, err = _cloudRequest(ctx, app, user.Token, "PUT", u, "", nil)
+	if e, ok := err.(*CloudError); ok && e.StatusCode == 409 {
+		return nil
+	}
+	return err
+}
+
+// _getUserID returns the id of the Kii user with the login name.
+func _getUserID(ctx context.Context, app App, user User, username string) (id string, err error) {
+	defer observe(targetCloud, "get-user", time.Now(), &err)
+	u := cloudURL(app, "/users/LOGIN_NAME:"+url.PathEscape(username))
+	b, err := _cloudRequest(ctx, app, user.Token, "GET", u, "", nil)
+	if e, ok := err.(*CloudError); ok && e.StatusCode == 404 {
+		return "", fmt.Errorf("user %s is not found", username)
+	}
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		UserID string `json:"userID"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return "", err
+	}
+	if resp.UserID == "" {
+		return "", fmt.Errorf("user %s is not found", username)
+	}
+	return resp.UserID, nil
+}
+
+// _listCloudEndNodes lists end-nodes of the gateway registered on Kii Cloud.
+func _listCloudEndNodes(ctx context.Context, app App, user User, gatewayID string) (nodes []Node, err error) {
+	defer observe(targetCloud, "list-end-nodes", time.Now(), &err)
+	paginationKey := ""
+	for {
+		u := thingIFURL(app, "/things/"+gatewayID+"/end-nodes")
+		if paginationKey != "" {
+			u += "?paginationKey=" + url.QueryEscape(paginationKey)
+		}
+		b, err := _cloudRequest(ctx, app, user.Token, "GET", u, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			Results []struct {
+				ThingID       string `json:"thingID"`
+				VendorThingID string `json:"vendorThingID"`
+			} `json:"results"`
+			NextPaginationKey string `json:"nextPaginationKey"`
+		}
+		err = json.Unmarshal(b, &resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Results {
+			nodes = append(nodes, Node{ID: r.ThingID, VID: r.VendorThingID})
+		}
+		if resp.NextPaginationKey == "" {
+			return nodes, nil
+		}
+		paginationKey = resp.NextPaginationKey
+	}
+}
+
+// _thingExists tells whether the thing is registered on Kii Cloud.
+func _thingExists(ctx context.Context, app App, user User, thingID string) (exists bool, err error) {
+	defer observe(targetCloud, "get-thing", time.Now(), &err)
+	_, err = _cloudRequest(ctx, app, user.Token, "GET", cloudURL(app, "/things/"+thingID), "", nil)
+	if e, ok := err.(*CloudError); ok && e.StatusCode == 404 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// _getThing returns the thing type and the firmware version of the thing
+// registered on Kii Cloud.
+func _getThing(ctx context.Context, app App, user User, thingID string) (thingType string, firmwareVersion string, err error) {
+	defer observe(targetCloud, "get-thing", time.Now(), &err)
+	b, err := _cloudRequest(ctx, app, user.Token, "GET", cloudURL(app, "/things/"+thingID), "", nil)
+	if err != nil {
+		return "", "", err
+	}
+	var resp struct {
+		ThingType       string `json:"_thingType"`
+		FirmwareVersion string `json:"_firmwareVersion"`
+	}
+	err = json.Unmarshal(b, &resp)
+	return resp.ThingType, resp.FirmwareVersion, err
+}
+
+func _changeThingPassword(ctx context.Context, app App, user User, thingID string, oldPassword string, newPassword string) (err error) {
+	defer observe(targetCloud, "change-thing-password", time.Now(), &err)
+	body, err := json.Marshal(map[string]string{"oldPassword": oldPassword, "newPassword": newPassword})
+	if err != nil {
+		return err
+	}
+	_, err = _cloudRequest(ctx, app, user.Token, "PUT", cloudURL(app, "/things/"+thingID+"/password"),
+		"application/vnd.kii.ChangeThingPasswordRequest+json", body)
+	return err
+}
+
+// _getFirmwareVersion returns the firmware version of the thing. It is empty
+// when the thing has no firmware version.
+func _getFirmwareVersion(ctx context.Context, app App, user User, thingID string) (version string, err error) {
+	defer observe(targetCloud, "get-firmware-version", time.Now(), &err)
+	b, err := _cloudRequest(ctx, app, user.Token, "GET", thingIFURL(app, "/things/"+thingID+"/firmware-version"), "", nil)
+	if err != nil || len(b) == 0 {
+		return "", err
+	}
+	var resp struct {
+		FirmwareVersion string `json:"firmwareVersion"`
+	}
+	err = json.Unmarshal(b, &resp)
+	return resp.FirmwareVersion, err
+}
+
+func _updateFirmwareVersion(ctx context.Context, app App, user User, thingID string, version string) (err error) {
+	defer observe(targetCloud, "update-firmware-version", time.Now(), &err)
+	body, err := json.Marshal(map[string]string{"firmwareVersion": version})
+	if err != nil {
+		return err
+	}
+	_, err = _cloudRequest(ctx, app, user.Token, "PUT", thingIFURL(app, "/things/"+thingID+"/firmware-version"),
+		"application/vnd.kii.ThingFirmwareVersionUpdateRequest+json", body)
+	return err
+}
+
+// _getCommandState returns the state of the command posted to the thing,
+// e.g. SENDING, DELIVERED, DONE.
+func _getCommandState(ctx context.Context, app App, user User, thingID string, commandID string) (state string, err error) {
+	defer observe(targetCloud, "get-command", time.Now(), &err)
+	b, err := _cloudRequest(ctx, app, user.Token, "GET", thingIFURL(app, "/targets/thing:"+thingID+"/commands/"+commandID), "", nil)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		CommandState string `json:"commandState"`
+	}
+	err = json.Unmarshal(b, &resp)
+	return resp.CommandState, err
+}
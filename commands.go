@@ -1,16 +1,23 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v2"
 )
 
 var Commands = []cli.Command{
+	userRegister,
 	userLogin,
+	userCommand,
 	auth,
 	onboardGateway,
 	addOwner,
@@ -19,115 +26,163 @@ var Commands = []cli.Command{
 	postCommand,
 	restore,
 	replaceNode,
+	replaceGateway,
+	reconcile,
+	history,
 	showDB,
+	configCommand,
+	useApp,
+	useGateway,
+	contextCommand,
+	setupGateway,
+	statusCommand,
+	firmwareCommand,
+	nodeCommand,
+	rotateNodePassword,
+	exportNodeCredentials,
+	ownerCommand,
+	completionCommand,
+	shellCommand,
+	completeCommand,
 }
 
 var userLogin = cli.Command{
 	Name:      "user-login",
-	Usage:     "user-login --username <user name> --password <password> --app-name <app name>",
-	UsageText: "Kii Cloud User Login. This user will be an owner of the Gateway",
-	Flags: []cli.Flag{
-		cli.StringFlag{
-			Name:  "username",
-			Usage: "Gateway owner user name (Kii Cloud User)",
-		},
-		cli.StringFlag{
-			Name:  "password",
-			Usage: "Gateway owner password (Kii Cloud User)",
-		},
-		cli.StringFlag{
-			Name: "app-name",
+	Usage:     "user-login --username <user name> --password <password> [--register] --app-name <app name>",
+	UsageText: "Kii Cloud User Login. This user will be an owner of the Gateway. It fails when the user doesn't exist unless --register is given",
+	Flags: joinFlags(
+		[]cli.Flag{
+			cli.StringFlag{
+				Name:  "username",
+				Usage: "Gateway owner user name (Kii Cloud User)",
+			},
+			cli.StringFlag{
+				Name: "app-name",
+			},
+			cli.BoolFlag{
+				Name:  "register",
+				Usage: "Register the user when the login fails",
+			},
 		},
-	},
+		registrationFlags,
+		secretFlags("password", "Gateway owner password (Kii Cloud User)"),
+	),
 	Action: func(c *cli.Context) {
 		username := c.String("username")
-		password := c.String("password")
-		appName := c.String("app-name")
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
 		if username == "" {
-			log.Fatalln("no username is specified")
+			stdLog.Fatalln("no username is specified")
 		}
-		if password == "" {
-			log.Fatalln("no password is specified")
-		}
-		if appName == "" {
-			log.Fatalln("no app-name is specified")
-		}
-		app := gConfig.Apps[appName]
-		userID, userToken, err := _userLogin(app, username, password)
+		password, err := readSecret(c, "password", secretKiiUser, appName, username)
 		if err != nil {
-			log.Fatalln("failed to login with the user: ", err)
+			stdLog.Fatalln(err)
 		}
-		user := User{
-			ID:    userID,
-			Token: userToken,
+		a := startAudit(c, "user-login")
+		a.Target(username)
+		var reg *UserRegistration
+		if c.Bool("register") {
+			r := registrationOf(c, username)
+			reg = &r
 		}
-		j, _ := json.Marshal(user)
-		err = db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("users"))
-			err = b.Put([]byte(appName), j)
-			if err != nil {
-				log.Println(err)
-			}
-			return err
-		})
+		user, err := doUserLogin(gCtx, appName, gwKey, app, username, password, reg)
 		if err != nil {
-			log.Fatalln("failed to store user: ", err)
+			a.Fatal(err)
 		}
+		a.ID("userID", user.ID)
+		a.Done()
 	},
 }
 
+// doUserLogin logins as the Kii Cloud user and stores it for the app. The
+// user is registered by reg when the login fails and reg is not nil.
+func doUserLogin(ctx context.Context, appName string, gwKey string, app App, username string, password string, reg *UserRegistration) (user User, err error) {
+	defer func() { recordStep(gwKey, stepUserLogin, err) }()
+	userID, userToken, err := loginOrRegister(ctx, app, username, password, reg)
+	if err != nil {
+		return user, err
+	}
+	user = User{
+		ID:       userID,
+		Token:    userToken,
+		Username: username,
+	}
+	if err := storeUser(appName, user); err != nil {
+		return user, fmt.Errorf("failed to store user: %v", err)
+	}
+	// The user becomes the current user of the app only when there is none,
+	// switching is left to user use.
+	prev := getContext(contextUser + appName)
+	if prev != "" {
+		if _, err := storedUser(appName, prev); err != nil {
+			prev = ""
+		}
+	}
+	if prev == "" {
+		if err := setContext(contextUser+appName, username); err != nil {
+			return user, fmt.Errorf("failed to store context: %v", err)
+		}
+	} else if prev != username {
+		fmt.Fprintf(os.Stderr, "the current user of %s is still %s. switch to %s by user use %s\n", appName, prev, username, username)
+	}
+	return user, nil
+}
+
 var auth = cli.Command{
 	Name:      "auth",
 	Usage:     "auth --username <user name> --password <password> --app-name <app name>",
 	UsageText: "gateway local rest api authentication",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:  "username",
 			Usage: "Gateway admin user name",
 		},
-		cli.StringFlag{
-			Name:  "password",
-			Usage: "Gateway admin password",
-		},
 		cli.StringFlag{
 			Name: "app-name",
 		},
-	},
+	}, secretFlags("password", "Gateway admin password")...),
 	Action: func(c *cli.Context) {
 		username := c.String("username")
-		password := c.String("password")
-		appName := c.String("app-name")
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
 		if username == "" {
-			log.Fatalln("no username is specified")
-		}
-		if password == "" {
-			log.Fatalln("no password is specified")
-		}
-		if appName == "" {
-			log.Fatalln("no app-name is specified")
+			stdLog.Fatalln("no username is specified")
 		}
-
-		app := gConfig.Apps[appName]
-		addr := gConfig.GatewayAddress
-		token, err := localAuth(addr, app, username, password)
+		password, err := readSecret(c, "password", secretGatewayAdmin, appName, username)
 		if err != nil {
-			log.Fatalln("local rest api authenticatoin error: %+v", err)
+			stdLog.Fatalln(err)
 		}
-		log.Println("token: ", token)
-		err = db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("tokens"))
-			err = b.Put([]byte(appName), []byte(token))
-			if err != nil {
-				log.Println(err)
-			}
-			return err
-		})
+		addr := gatewayAddress(c)
+		a := startAudit(c, "auth")
+		a.Target(username)
+		err = doAuth(gCtx, addr, gwKey, app, username, password)
 		if err != nil {
-			log.Fatalln("failed to store token")
+			a.Fatal(err)
 		}
+		a.Done()
 	},
 }
 
+// doAuth gets a token of the gateway local rest api and stores it.
+func doAuth(ctx context.Context, addr GatewayAddress, gwKey string, app App, username string, password string) (err error) {
+	defer func() { recordStep(gwKey, stepAuth, err) }()
+	token, err := localAuth(ctx, addr, app, username, password)
+	if err != nil {
+		return fmt.Errorf("local rest api authenticatoin error: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tokens"))
+		return b.Put([]byte(gwKey), []byte(token))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store token: %v", err)
+	}
+	stdLog.Println("token is stored.")
+	return nil
+}
+
 var onboardGateway = cli.Command{
 	Name:  "onboard-gateway",
 	Usage: "onboard-gateway [--master] --app-name <app name>",
@@ -140,101 +195,107 @@ var onboardGateway = cli.Command{
 		},
 	},
 	Action: func(c *cli.Context) {
-		appName := c.String("app-name")
-		if appName == "" {
-			log.Fatalln("no app-name is specified")
-		}
-		master := c.Bool("master")
-		var token string
-		db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("tokens"))
-			v := b.Get([]byte(appName))
-			token = string(v[:])
-			return nil
-		})
-		log.Printf("token %s\n", token)
-		if token == "" {
-			log.Fatalln("no auth token is stored for the specified app.")
-		}
-		app := gConfig.Apps[appName]
-		addr := gConfig.GatewayAddress
-		var f func(GatewayAddress, App, string) (string, error)
-		if master {
-			f = _onboardMasterGateway
-		} else {
-			f = _onboardGateway
-		}
-		id, err := f(addr, app, token)
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
+		addr := gatewayAddress(c)
+		a := startAudit(c, "onboard-gateway")
+		a.Target(fmt.Sprintf("%s:%d", addr.Host, addr.Port))
+		id, err := doOnboardGateway(gCtx, addr, gwKey, app, c.Bool("master"))
 		if err != nil {
-			log.Fatalln("local rest api authenticatoin error: %+v", err)
-		}
-		log.Printf("id %s\n", id)
-		err = db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("gateway-ids"))
-			err = b.Put([]byte(appName), []byte(id))
-			if err != nil {
-				log.Println(err)
-			}
-			return err
-		})
-		if err != nil {
-			log.Fatalln("failed to store id")
+			a.Fatal(err)
 		}
+		a.ID("gatewayID", id)
+		a.Done()
 	},
 }
 
+// doOnboardGateway onboards the gateway with the stored token and stores the
+// gateway thing id.
+func doOnboardGateway(ctx context.Context, addr GatewayAddress, gwKey string, app App, master bool) (id string, err error) {
+	defer func() { recordStep(gwKey, stepOnboardGateway, err) }()
+	var token string
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tokens"))
+		v := b.Get([]byte(gwKey))
+		token = string(v[:])
+		return nil
+	})
+	if token == "" {
+		return "", errors.New("no auth token is stored for the specified app.")
+	}
+	var f func(context.Context, GatewayAddress, App, string) (string, error)
+	if master {
+		f = _onboardMasterGateway
+	} else {
+		f = _onboardGateway
+	}
+	id, err = f(ctx, addr, app, token)
+	if err != nil {
+		return "", fmt.Errorf("failed to onboard gateway: %v", err)
+	}
+	stdLog.Debugf("id %s\n", id)
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("gateway-ids"))
+		return b.Put([]byte(gwKey), []byte(id))
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store id: %v", err)
+	}
+	return id, nil
+}
+
 var addOwner = cli.Command{
 	Name:  "add-owner",
 	Usage: "add-owner --gateway-password <gateway password> --app-name <app name>",
-	Flags: []cli.Flag{
-		cli.StringFlag{
-			Name:  "gateway-password",
-			Usage: "Password of the gateway. It is configured in coonfig file of Gateway Agent.",
-		},
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name: "app-name",
 		},
-	},
+		userFlag,
+	}, secretFlags("gateway-password", "Password of the gateway. It is configured in coonfig file of Gateway Agent")...),
 	Action: func(c *cli.Context) {
-		gatewayPassword := c.String("gateway-password")
-		appName := c.String("app-name")
-		if gatewayPassword == "" {
-			log.Fatalln("no gateway-password specified.")
-		}
-		if appName == "" {
-			log.Fatalln("no app-name specified.")
-		}
-		var id string
-		var user User
-		err := db.View(func(tx *bolt.Tx) error {
-			// Retrieve gateway id.
-			b := tx.Bucket([]byte("gateway-ids"))
-			v := b.Get([]byte(appName))
-			id = string(v[:])
-
-			// Retrieve user.
-			b2 := tx.Bucket([]byte("users"))
-			v2 := b2.Get([]byte(appName))
-			err := json.Unmarshal(v2, &user)
-			return err
-		})
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
+		id := storedGatewayID(gwKey)
 		if id == "" {
-			log.Fatalln("no gateway-id is stored. please execute onboard-gateway.")
+			stdLog.Fatalln("no gateway-id is stored. please execute onboard-gateway.")
 		}
+		gatewayPassword, err := readSecret(c, "gateway-password", secretGatewayThing, appName, id)
 		if err != nil {
-			log.Fatalln("no login user is stored. please execute login-user.: ", err)
+			stdLog.Fatalln(err)
 		}
-		log.Println("gateway thing id: ", id)
-		log.Println("user: ", user)
-		app := gConfig.Apps[appName]
-
-		err = _addOwner(app, user.ID, user.Token, id, gatewayPassword)
+		a := startAudit(c, "add-owner")
+		a.Target(id)
+		err = doAddOwner(gCtx, gwKey, app, mustUser(c, appName), gatewayPassword)
 		if err != nil {
-			log.Fatalln("failed to store id. ", err)
+			a.Fatal(err)
 		}
+		a.Done()
 	},
 }
 
+// doAddOwner adds the stored user as an owner of the stored gateway. The user
+// is given as stored, as users stored by older versions have no user name.
+func doAddOwner(ctx context.Context, gwKey string, app App, user User, gatewayPassword string) (err error) {
+	defer func() { recordStep(gwKey, stepAddOwner, err) }()
+	id := storedGatewayID(gwKey)
+	if id == "" {
+		return errors.New("no gateway-id is stored. please execute onboard-gateway.")
+	}
+	if user.ID == "" || user.Token == "" {
+		return errors.New("the stored user has no id or token. re-run user-login")
+	}
+	stdLog.Debugln("gateway thing id: ", id)
+	stdLog.Debugln("user: ", user.ID)
+	err = _addOwner(ctx, app, user.ID, user.Token, id, gatewayPassword)
+	if err != nil {
+		return fmt.Errorf("failed to add owner: %v", err)
+	}
+	return nil
+}
+
 var listPendingNodes = cli.Command{
 	Name:      "list-pending-nodes",
 	Usage:     "list-pending-nodes --app-name <app name>",
@@ -246,24 +307,25 @@ var listPendingNodes = cli.Command{
 		},
 	},
 	Action: func(c *cli.Context) {
-		appName := c.String("app-name")
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
 		var token string
 		err := db.View(func(tx *bolt.Tx) error {
 			b := tx.Bucket([]byte("tokens"))
-			v := b.Get([]byte(appName))
+			v := b.Get([]byte(gwKey))
 			token = string(v[:])
 			return nil
 		})
 		if err != nil || token == "" {
-			log.Fatalln("token is not stored for the specified app")
+			stdLog.Fatalln("token is not stored for the specified app")
 		}
-		app := gConfig.Apps[appName]
-		addr := gConfig.GatewayAddress
-		l, err := _listPendingNodes(addr, app, token)
+		addr := gatewayAddress(c)
+		l, err := _listPendingNodes(gCtx, addr, app, token)
 		if err != nil {
-			log.Fatalln("can not list pending nodes: ", err)
+			stdLog.Fatalln("can not list pending nodes: ", err)
 		}
-		log.Printf("pending nodes: \n%v", l)
+		fmt.Printf("pending nodes: \n%v\n", l)
 	},
 }
 
@@ -272,18 +334,15 @@ var onboardNode = cli.Command{
 	Usage:     "onboard-node --node-vid <end-node vendor thing id> --node-password <end-node password> --node-type <end-node thing type> --node-fv <end-node firmware version> --app-name <app name>",
 	Aliases:   []string{"on"},
 	UsageText: "Execute onboard for specified end-node",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:  "node-vid",
 			Usage: "end node vendor thing id",
 		},
-		cli.StringFlag{
-			Name:  "node-password",
-			Usage: "end node password",
-		},
 		cli.StringFlag{
 			Name: "app-name",
 		},
+		userFlag,
 		cli.StringFlag{
 			Name:  "node-type",
 			Usage: "end node thingType",
@@ -292,71 +351,107 @@ var onboardNode = cli.Command{
 			Name:  "node-fv",
 			Usage: "end node firmware version",
 		},
-	},
+		cli.StringSliceFlag{
+			Name:  "label",
+			Usage: "key=value label of the end-node stored in the DB. Can be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "generate-password",
+			Usage: "generate the end node password and store it encrypted in the DB",
+		},
+	}, secretFlags("node-password", "end node password")...),
 	Action: func(c *cli.Context) {
 		nodeVID := c.String("node-vid")
-		nodePass := c.String("node-password")
-		appName := c.String("app-name")
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
 		nodeType := c.String("node-type")
 		nodeFv := c.String("node-fv")
+		labels, err := parseLabels(c.StringSlice("label"))
+		if err != nil {
+			stdLog.Fatalln(err)
+		}
 		var gatewayID string
-		var user User
 		var token string
-		err := db.View(func(tx *bolt.Tx) error {
+		db.View(func(tx *bolt.Tx) error {
 			b := tx.Bucket([]byte("gateway-ids"))
-			v := b.Get([]byte(appName))
+			v := b.Get([]byte(gwKey))
 			gatewayID = string(v[:])
 
-			b2 := tx.Bucket([]byte("users"))
-			v2 := b2.Get([]byte(appName))
-			err := json.Unmarshal(v2, &user)
-			if err != nil {
-				return err
-			}
-
 			b3 := tx.Bucket([]byte("tokens"))
-			v3 := b3.Get([]byte(appName))
+			v3 := b3.Get([]byte(gwKey))
 			token = string(v3[:])
 			return nil
 		})
 		if gatewayID == "" {
-			log.Fatalln("gateway id is not stored for the specified app. execute onboard-gateway.")
+			stdLog.Fatalln("gateway id is not stored for the specified app. execute onboard-gateway.")
+		}
+		user := mustUser(c, appName)
+		if token == "" {
+			stdLog.Fatalln("token is not stored for the specified app. execute auth.")
 		}
+		profile, hasProfile, err := thingTypeProfile(nodeType)
 		if err != nil {
-			log.Fatalln("no login user. execute user-login.")
+			stdLog.Fatalln(err)
 		}
-		if token == "" {
-			log.Fatalln("token is not stored for the specified app. execute auth.")
+		if hasProfile {
+			if err := profile.validateVID(nodeVID); err != nil {
+				stdLog.Fatalln(err)
+			}
+			if nodeFv, err = profile.firmware(nodeFv); err != nil {
+				stdLog.Fatalln(err)
+			}
 		}
-		app := gConfig.Apps[appName]
-		nodeID, err := _onboardNode(app, user, gatewayID, nodeVID, nodePass, nodeType, nodeFv)
+		generate := c.Bool("generate-password")
+		nodePass, err := nodePassword(c, appName, nodeVID, profile, hasProfile)
 		if err != nil {
-			log.Fatalln("failed to onboard node: ", err)
+			stdLog.Fatalln(err)
+		}
+		a := startAudit(c, "onboard-node")
+		a.Target(nodeVID)
+		if generate {
+			if err := stageNodePassword(appName, nodeVID, nodePass); err != nil {
+				a.Fatal("failed to store end node password: ", err)
+			}
 		}
+		nodeID, err := _onboardNode(gCtx, app, user, gatewayID, nodeVID, nodePass, nodeType, nodeFv)
+		if generate {
+			if err := settleNodePassword(appName, nodeVID, err); err != nil {
+				stdLog.Errorln("failed to store end node password: ", err)
+			}
+		}
+		if err != nil {
+			a.Fatal("failed to onboard node: ", err)
+		}
+		a.ID("thingID", nodeID)
 		node := Node{
 			ID:  nodeID,
 			VID: nodeVID,
 		}
 
-		// Store end-node mapping.
-		err = db.Update(func(tx *bolt.Tx) error {
-			b, err := tx.CreateBucketIfNotExists([]byte("nodes:" + appName))
-			if err != nil {
-				return err
+		// Store end-node record.
+		err = updateNodeRecord(appName, node.VID, func(r *NodeRecord) {
+			r.ThingID, r.ThingType, r.Firmware = node.ID, nodeType, nodeFv
+			now := time.Now()
+			r.Gateway, r.Owner, r.OnboardedAt = gatewayID, "user:"+user.ID, &now
+			if r.Labels == nil {
+				r.Labels = map[string]string{}
+			}
+			for k, v := range labels {
+				r.Labels[k] = v
 			}
-			err = b.Put([]byte(node.VID), []byte(node.ID))
-			return err
 		})
 		if err != nil {
-			log.Fatalln("failed to store end-node: ", err)
+			a.Fatal("failed to store end-node: ", err)
 		}
 
 		// Tell End Node mapping to Gateway Agent.
-		addr := gConfig.GatewayAddress
-		err = _mapNode(addr, app, node, token)
+		addr := gatewayAddress(c)
+		err = _mapNode(gCtx, addr, app, node, token)
 		if err != nil {
-			log.Fatalln("failed to map end-node: ", err)
+			a.Fatal("failed to map end-node: ", err)
 		}
+		a.Done()
 	},
 }
 
@@ -378,6 +473,7 @@ var postCommand = cli.Command{
 		cli.StringFlag{
 			Name: "app-name",
 		},
+		userFlag,
 		cli.BoolFlag{
 			Name: "trait",
 		},
@@ -385,84 +481,133 @@ var postCommand = cli.Command{
 	Action: func(c *cli.Context) {
 		nodeVID := c.String("node-vid")
 		path := c.String("command-file")
-		appName := c.String("app-name")
+		appName := appNameOf(c)
+		app := mustApp(appName)
 		isTrait := c.Bool("trait")
 
 		b, err := ioutil.ReadFile(path)
 		if err != nil {
-			log.Fatalln("can not read command-file: ", err)
+			stdLog.Fatalln("can not read command-file: ", err)
 		}
 
-		var user User
-		var nodeID string
-		err = db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("users"))
-			v := b.Get([]byte(appName))
-			err := json.Unmarshal(v, &user)
-			if err != nil {
-				return err
+		user := mustUser(c, appName)
+		var nodeID, thingType string
+		db.View(func(tx *bolt.Tx) error {
+			if r := getNodeRecord(tx, appName, nodeVID); r != nil {
+				nodeID, thingType = r.ThingID, r.ThingType
 			}
-
-			b2 := tx.Bucket([]byte("nodes:" + appName))
-			v2 := b2.Get([]byte(nodeVID))
-			nodeID = string(v2[:])
 			return nil
 		})
 		node := Node{
 			ID:  nodeID,
 			VID: nodeVID,
 		}
-		if err != nil {
-			log.Fatalln("can not find user in specified app. execute user-login. ", err)
-		}
 		if nodeID == "" {
-			log.Fatalln("can not find end-node. execute onboard-node")
+			stdLog.Fatalln("can not find end-node. execute onboard-node")
+		}
+		// Complete the command by the profile of the thing type recorded by
+		// onboard-node.
+		if thingType != "" {
+			if profile, ok := gConfig.ThingTypes[thingType]; ok {
+				isTrait = isTrait || profile.Traits
+				if !isTrait {
+					b, err = profile.completeCommand(b)
+					if err != nil {
+						stdLog.Fatalln("can not parse command-file: ", err)
+					}
+				}
+			}
 		}
-		app := gConfig.Apps[appName]
+		a := startAudit(c, "post-command")
+		a.Target(nodeVID)
+		a.ID("thingID", node.ID)
 		if isTrait {
-			resp, err := _postTraitCommand(app, user, node.ID, b)
+			resp, err := _postTraitCommand(gCtx, app, user, node.ID, b)
 			if err != nil {
-				log.Fatalln("failed to post trait command: ", err)
+				a.Fatal("failed to post trait command: ", err)
 			}
-			log.Printf("post trait command resp: %v", resp)
+			a.ID("commandID", resp.CommandID)
+			a.Done()
+			fmt.Printf("post trait command resp: %v\n", resp)
 			return
 		}
-		resp, err := _postCommand(app, user, node.ID, b)
+		resp, err := _postCommand(gCtx, app, user, node.ID, b)
 		if err != nil {
-			log.Fatalln("failed to post command: ", err)
+			a.Fatal("failed to post command: ", err)
 		}
-		log.Printf("post command resp: %v", resp)
+		a.ID("commandID", resp.CommandID)
+		a.Done()
+		fmt.Printf("post command resp: %v\n", resp)
 	},
 }
 
 var restore = cli.Command{
-	Name:      "restore",
-	Usage:     "restore --app-name <app name>",
-	Aliases:   []string{"r"},
-	UsageText: "Restore the gateway. Gateway Agent should be started in restore mode.",
+	Name:    "restore",
+	Usage:   "restore [--verify-only] [--no-verify] [--wait <duration>] --app-name <app name>",
+	Aliases: []string{"r"},
+	UsageText: `Restore the gateway. Gateway Agent should be started in restore mode.
+	After restore, waits for Gateway Agent to come back and maps end-nodes stored in the DB but not mapped on Gateway Agent.`,
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name: "app-name",
 		},
+		cli.BoolFlag{
+			Name:  "no-verify",
+			Usage: "Don't verify end-node mappings after restore",
+		},
+		cli.BoolFlag{
+			Name:  "verify-only",
+			Usage: "Skip restore and only verify end-node mappings",
+		},
+		cli.DurationFlag{
+			Name:  "wait",
+			Value: 2 * time.Minute,
+			Usage: "How long to wait for Gateway Agent to come back",
+		},
+		cli.DurationFlag{
+			Name:  "interval",
+			Value: 5 * time.Second,
+			Usage: "Interval to check whether Gateway Agent came back",
+		},
 	},
 	Action: func(c *cli.Context) {
 		var token string
-		appName := c.String("app-name")
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
 		db.View(func(tx *bolt.Tx) error {
 			b := tx.Bucket([]byte("tokens"))
-			v := b.Get([]byte(appName))
+			v := b.Get([]byte(gwKey))
 			token = string(v[:])
 			return nil
 		})
 		if token == "" {
-			log.Fatalln("token is not stored for the specified app. execute auth.")
+			stdLog.Fatalln("token is not stored for the specified app. execute auth.")
 		}
-		app := gConfig.Apps[appName]
-		addr := gConfig.GatewayAddress
-		err := _restore(addr, app, token)
+		addr := gatewayAddress(c)
+		a := startAudit(c, "restore")
+		a.Target(fmt.Sprintf("%s:%d", addr.Host, addr.Port))
+		if !c.Bool("verify-only") {
+			err := _restore(gCtx, addr, app, token)
+			if err != nil {
+				a.Fatal("failed to restore: ", err)
+			}
+			stdLog.Println("restore is requested.")
+		}
+		if c.Bool("no-verify") {
+			a.Done()
+			return
+		}
+		mapped, err := waitForAgent(gCtx, addr, app, token, c.Duration("wait"), c.Duration("interval"))
 		if err != nil {
-			log.Fatalln("failed to restore: ", err)
+			a.Fatal(err, "\nexecute auth and restore --verify-only when Gateway Agent requires new token.")
+		}
+		report := verifyNodeMappings(gCtx, addr, appName, storedGatewayID(gwKey), app, token, mapped)
+		report.Print(os.Stdout)
+		if len(report.Failed) > 0 {
+			a.Fatal(len(report.Failed), " end-node(s) are not mapped on Gateway Agent")
 		}
+		a.Done()
 	},
 }
 
@@ -471,7 +616,7 @@ var replaceNode = cli.Command{
 	Usage:     "replace-node --node-vid <old end-node vendor thing id> --new-vid <new end-node vendor thing id> --node-password <end-node password> --app <app name>",
 	Aliases:   []string{"rp"},
 	UsageText: "Replace end-node hardware with new one.",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:  "node-vid",
 			Usage: "end node vendor thing id to be replaced.",
@@ -480,72 +625,101 @@ var replaceNode = cli.Command{
 			Name:  "new-vid",
 			Usage: "new end node vendor thing id.",
 		},
-		cli.StringFlag{
-			Name:  "node-password",
-			Usage: "end node password",
-		},
 		cli.StringFlag{
 			Name: "app-name",
 		},
-	},
+		userFlag,
+		cli.BoolFlag{
+			Name:  "generate-password",
+			Usage: "generate the new end node password and store it encrypted in the DB",
+		},
+	}, secretFlags("node-password", "end node password")...),
 	Action: func(c *cli.Context) {
 		nodeVID := c.String("node-vid")
 		newVID := c.String("new-vid")
-		nodePass := c.String("node-password")
-		appName := c.String("app-name")
-		var user User
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
+		user := mustUser(c, appName)
 		var nodeID string
+		var thingType string
 		var token string
-		err := db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("users"))
-			v := b.Get([]byte(appName))
-			err := json.Unmarshal(v, &user)
-			if err != nil {
-				return err
+		db.View(func(tx *bolt.Tx) error {
+			if r := getNodeRecord(tx, appName, nodeVID); r != nil {
+				nodeID, thingType = r.ThingID, r.ThingType
 			}
 
-			b2 := tx.Bucket([]byte("nodes:" + appName))
-			v2 := b2.Get([]byte(nodeVID))
-			nodeID = string(v2[:])
-
 			b3 := tx.Bucket([]byte("tokens"))
-			v3 := b3.Get([]byte(appName))
+			v3 := b3.Get([]byte(gwKey))
 			token = string(v3[:])
 			return nil
 		})
-		if err != nil {
-			log.Fatalln("no user stored for the specified app. execute user-login.")
-		}
 		if nodeID == "" {
-			log.Fatalln("no end-node is onboard with the specified VID. execute onboard-endnode.")
+			stdLog.Fatalln("no end-node is onboard with the specified VID. execute onboard-endnode.")
 		}
 		if token == "" {
-			log.Fatalln("token is not stored for the specified app. execute auth.")
+			stdLog.Fatalln("token is not stored for the specified app. execute auth.")
+		}
+		profile, hasProfile, err := thingTypeProfile(thingType)
+		if err != nil {
+			stdLog.Fatalf("thing type of %s: %v. execute firmware list --refresh when it is not recorded\n", nodeVID, err)
+		}
+		if hasProfile {
+			if err := profile.validateVID(newVID); err != nil {
+				stdLog.Fatalln(err)
+			}
+		}
+		generate := c.Bool("generate-password")
+		nodePass, err := nodePassword(c, appName, newVID, profile, hasProfile)
+		if err != nil {
+			stdLog.Fatalln(err)
+		}
+		a := startAudit(c, "replace-node")
+		a.Target(nodeVID)
+		a.ID("thingID", nodeID)
+		if generate {
+			if err := stageNodePassword(appName, newVID, nodePass); err != nil {
+				a.Fatal("failed to store end node password: ", err)
+			}
+		}
+		err = _updateVID(gCtx, app, user, nodeID, newVID, nodePass)
+		if generate {
+			if err := settleNodePassword(appName, newVID, err); err != nil {
+				stdLog.Errorln("failed to store end node password: ", err)
+			}
 		}
-		app := gConfig.Apps[appName]
-		err = _updateVID(app, user, nodeID, newVID, nodePass)
 		if err != nil {
-			log.Fatalln("failed to update vendor thing id on Kii Cloud: ", err)
+			a.Fatal("failed to update vendor thing id on Kii Cloud: ", err)
 		}
-		addr := gConfig.GatewayAddress
+		addr := gatewayAddress(c)
 		node := Node{
 			ID:  nodeID,
 			VID: newVID,
 		}
-		err = _replaceNode(addr, app, node, token)
+		err = _replaceNode(gCtx, addr, app, node, token)
 		if err != nil {
-			log.Fatalln("failed to replace end-node on Gateway Agent: ", err)
+			a.Fatal("failed to replace end-node on Gateway Agent: ", err)
 		}
 		err = db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("nodes:" + appName))
-			// Remove the old entry if exit.
-			b.Delete([]byte(nodeVID))
-			// Put new entry.
-			return b.Put([]byte(node.VID), []byte(node.ID))
+			r := getNodeRecord(tx, appName, nodeVID)
+			if r == nil {
+				r = &NodeRecord{ThingID: node.ID}
+			}
+			// Move the record to the new vendor thing id.
+			if err := deleteNodeRecord(tx, appName, nodeVID); err != nil {
+				return err
+			}
+			r.VID, r.ReplacedFrom = node.VID, nodeVID
+			return putNodeRecord(tx, appName, *r)
 		})
 		if err != nil {
-			log.Fatalln("failed to store end-node in db: ", err)
+			a.Fatal("failed to store end-node in db: ", err)
+		}
+		// The password of the old hardware is no longer used.
+		if err := deleteNodeSecret(appName, nodeVID); err != nil {
+			stdLog.Errorln("failed to delete end node password: ", err)
 		}
+		a.Done()
 	},
 }
 
@@ -571,15 +745,15 @@ var showDB = cli.Command{
 		all := c.Bool("all")
 		bucketName := c.String("bucket")
 		if bucketName == "" && !all {
-			log.Fatalln("no bucket is specified")
+			stdLog.Fatalln("no bucket is specified")
 		}
 		if all {
 			db.View(func(tx *bolt.Tx) error {
 				return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
-					log.Println("****** bucket: ", string(name), " ******")
+					fmt.Println("****** bucket: ", string(name), " ******")
 					c := b.Cursor()
 					for k, v := c.First(); k != nil; k, v = c.Next() {
-						log.Printf("key: %s, value: %s\n", k, v)
+						fmt.Printf("key: %s, value: %s\n", k, v)
 					}
 					return nil
 				})
@@ -589,10 +763,137 @@ var showDB = cli.Command{
 				b := tx.Bucket([]byte(bucketName))
 				c := b.Cursor()
 				for k, v := c.First(); k != nil; k, v = c.Next() {
-					log.Printf("key: %s, value: %s\n", k, v)
+					fmt.Printf("key: %s, value: %s\n", k, v)
 				}
 				return nil
 			})
 		}
 	},
 }
+
+var configCommand = cli.Command{
+	Name:      "config",
+	Usage:     "config show [--resolved] | config validate",
+	UsageText: "Inspect the configuration.",
+	Subcommands: []cli.Command{
+		{
+			Name:      "show",
+			Usage:     "show [--resolved]",
+			UsageText: "Show the merged config files. Secrets are redacted.",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "resolved",
+					Usage: "Show the config after resolving references and GWM_* env variables",
+				},
+			},
+			Action: func(c *cli.Context) {
+				var v interface{}
+				if c.Bool("resolved") {
+					v = redactConfig(gConfig)
+				} else {
+					v = redactRawConfig(gConfigRaw)
+				}
+				b, err := yaml.Marshal(v)
+				if err != nil {
+					stdLog.Fatalln("can't marshal config: ", err)
+				}
+				fmt.Printf("# %s\n%s", strings.Join(gConfigFiles, ", "), b)
+			},
+		},
+		{
+			Name:      "validate",
+			Usage:     "validate",
+			UsageText: "Check the config statically. Exits with non-zero status when problems are found.",
+			Action: func(c *cli.Context) {
+				problems := validateConfig(gConfig, gConfigFiles, gConfigErr)
+				for _, p := range problems {
+					fmt.Println(p)
+				}
+				if len(problems) > 0 {
+					stdLog.Fatalf("%d problem(s) found in %s\n", len(problems), strings.Join(gConfigFiles, ", "))
+				}
+				fmt.Println("config is valid")
+			},
+		},
+	},
+}
+
+var useApp = cli.Command{
+	Name:      "use-app",
+	Usage:     "use-app <app name> | use-app --unset",
+	UsageText: "Set the app of the current context. It is used when --app-name is not given.",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "unset",
+			Usage: "Clear the app of the current context",
+		},
+	},
+	Action: func(c *cli.Context) {
+		var appName string
+		if !c.Bool("unset") {
+			appName = c.Args().First()
+			mustApp(appName)
+		}
+		err := setContext(contextApp, appName)
+		if err != nil {
+			stdLog.Fatalln("failed to store context: ", err)
+		}
+	},
+}
+
+var useGateway = cli.Command{
+	Name:      "use-gateway",
+	Usage:     "use-gateway <gateway name> | use-gateway --unset",
+	UsageText: "Set the gateway of the current context. Gateways are configured in gateways of config file.",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "unset",
+			Usage: "Clear the gateway of the current context. gateway-address is used",
+		},
+	},
+	Action: func(c *cli.Context) {
+		var name string
+		if !c.Bool("unset") {
+			name = c.Args().First()
+			if name == "" {
+				stdLog.Fatalln("no gateway name is specified")
+			}
+			mustGateway(name)
+		}
+		err := setContext(contextGateway, name)
+		if err != nil {
+			stdLog.Fatalln("failed to store context: ", err)
+		}
+	},
+}
+
+var contextCommand = cli.Command{
+	Name:      "context",
+	Usage:     "context show",
+	UsageText: "Inspect the current context.",
+	Subcommands: []cli.Command{
+		{
+			Name:      "show",
+			Usage:     "show",
+			UsageText: "Show the app, the gateway and the user resolved for commands and where they come from.",
+			Action: func(c *cli.Context) {
+				appName, appSource := resolveAppName(c)
+				if appName == "" {
+					fmt.Println("app: (none)")
+				} else {
+					fmt.Printf("app: %s (%s)\n", appName, appSource)
+				}
+				name, source := resolveGateway(c)
+				addr := mustGateway(name)
+				fmt.Printf("gateway: %s %s:%d (%s)\n", name, addr.Host, addr.Port, source)
+				if appName != "" {
+					if user, source := resolveUser(c, appName); user == "" {
+						fmt.Println("user: (the only user of the app)")
+					} else {
+						fmt.Printf("user: %s (%s)\n", user, source)
+					}
+				}
+			},
+		},
+	},
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/codegangsta/cli"
+)
+
+// completeCommandName is the hidden command the completion scripts call
+// with the words typed so far. The last word is the one being completed.
+const completeCommandName = "__complete"
+
+var completionCommand = cli.Command{
+	Name:      "completion",
+	Usage:     "completion bash|zsh|fish",
+	UsageText: "Print the shell completion script. e.g. source <(gwm-cli completion bash)",
+	Action: func(c *cli.Context) {
+		prog := filepath.Base(os.Args[0])
+		fn := regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(prog, "_")
+		var script string
+		switch c.Args().First() {
+		case "bash":
+			script = bashCompletion
+		case "zsh":
+			script = zshCompletion
+		case "fish":
+			script = fishCompletion
+		default:
+			stdLog.Fatalln("specify the shell: bash, zsh or fish")
+		}
+		fmt.Print(strings.Replace(strings.Replace(script, "{{prog}}", prog, -1), "{{func}}", fn, -1))
+	},
+}
+
+var completeCommand = cli.Command{
+	Name:            completeCommandName,
+	Hidden:          true,
+	SkipFlagParsing: true,
+	Action: func(c *cli.Context) {
+		words := c.Args()
+		if len(words) == 0 {
+			words = []string{""}
+		}
+		// Before is skipped, values in the DB are not completed when it
+		// can't be opened.
+		if d, err := openCompletionDB(); err == nil {
+			db = d
+		}
+		for _, s := range completions(c.App, words) {
+			fmt.Println(s)
+		}
+	},
+}
+
+const bashCompletion = `_{{func}}_complete() {
+    local IFS=$'\n'
+    COMPREPLY=($(compgen -W "$("${COMP_WORDS[0]}" __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)" -- "${COMP_WORDS[COMP_CWORD]}"))
+}
+complete -o default -F _{{func}}_complete {{prog}}
+`
+
+const zshCompletion = `#compdef {{prog}}
+_{{func}}_complete() {
+    local -a candidates
+    candidates=(${(f)"$(${words[1]} __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+    if (( ${#candidates} )); then
+        compadd -a candidates
+    else
+        _files
+    fi
+}
+compdef _{{func}}_complete {{prog}}
+`
+
+const fishCompletion = `function __{{func}}_complete
+    set -l tokens (commandline -opc)
+    set -l cur (commandline -ct)
+    set -l candidates ($tokens[1] __complete $tokens[2..-1] "$cur" 2>/dev/null)
+    if test (count $candidates) -gt 0
+        printf '%s\n' $candidates
+    else
+        __fish_complete_path "$cur"
+    end
+end
+complete -c {{prog}} -f -a '(__{{func}}_complete)'
+`
+
+// completions returns the candidates of the last word of words: command
+// names, flag names, or values of --app-name, --gateway, --node-vid,
+// --node-type, --thing-type and --bucket. Nothing is returned for the other
+// flag values so that the shell completes file names.
+func completions(app *cli.App, words []string) []string {
+	cur, prev := words[len(words)-1], words[:len(words)-1]
+	flags := app.Flags
+	var cmd *cli.Command
+	var subcommands []cli.Command
+	for i := 0; i < len(prev); i++ {
+		w := prev[i]
+		if strings.HasPrefix(w, "-") {
+			if !strings.Contains(w, "=") && takesValue(flags, w) {
+				i++
+			}
+			continue
+		}
+		if cmd != nil && len(subcommands) == 0 {
+			// An argument of the command.
+			continue
+		}
+		candidates := app.Commands
+		if cmd != nil {
+			candidates = subcommands
+		}
+		next := findCommand(candidates, w)
+		if next == nil {
+			return nil
+		}
+		cmd, subcommands = next, next.Subcommands
+		if len(next.Subcommands) == 0 {
+			flags = next.Flags
+		}
+	}
+	if len(prev) > 0 {
+		if last := prev[len(prev)-1]; strings.HasPrefix(last, "-") && !strings.Contains(last, "=") && takesValue(flags, last) {
+			return flagValues(strings.TrimLeft(last, "-"), words)
+		}
+	}
+	if strings.HasPrefix(cur, "-") {
+		if i := strings.Index(cur, "="); i >= 0 {
+			var l []string
+			for _, v := range flagValues(strings.TrimLeft(cur[:i], "-"), words) {
+				l = append(l, cur[:i+1]+v)
+			}
+			return l
+		}
+		return flagNames(flags)
+	}
+	switch {
+	case cmd == nil:
+		return commandNames(app.Commands)
+	case len(subcommands) > 0:
+		return commandNames(subcommands)
+	}
+	return nil
+}
+
+func findCommand(commands []cli.Command, name string) *cli.Command {
+	for i, cmd := range commands {
+		if cmd.HasName(name) {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func commandNames(commands []cli.Command) []string {
+	var l []string
+	for _, cmd := range commands {
+		if !cmd.Hidden {
+			l = append(l, cmd.Name)
+		}
+	}
+	return l
+}
+
+// flagNames returns the names of flags with dashes.
+func flagNames(flags []cli.Flag) []string {
+	var l []string
+	for _, f := range flags {
+		for _, name := range strings.Split(f.GetName(), ",") {
+			name = strings.TrimSpace(name)
+			if len(name) == 1 {
+				l = append(l, "-"+name)
+			} else {
+				l = append(l, "--"+name)
+			}
+		}
+	}
+	return l
+}
+
+// takesValue tells whether the flag given as word is followed by its value.
+func takesValue(flags []cli.Flag, word string) bool {
+	name := strings.TrimLeft(word, "-")
+	for _, f := range flags {
+		for _, n := range strings.Split(f.GetName(), ",") {
+			if strings.TrimSpace(n) != name {
+				continue
+			}
+			switch f.(type) {
+			case cli.BoolFlag, cli.BoolTFlag:
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func flagValues(name string, words []string) []string {
+	switch name {
+	case "app-name":
+		return appNames(gConfig.Apps)
+	case "gateway":
+		return append([]string{defaultGateway}, gatewayNames(gConfig.Gateways)...)
+	case "node-vid":
+		if db == nil {
+			return nil
+		}
+		var vids []string
+		if nodes, err := storedNodes(completionAppName(words)); err == nil {
+			for vid := range nodes {
+				vids = append(vids, vid)
+			}
+		}
+		sort.Strings(vids)
+		return vids
+	case "user":
+		if db == nil {
+			return nil
+		}
+		var names []string
+		if users, err := storedUsers(completionAppName(words)); err == nil {
+			for name := range users {
+				if name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+		sort.Strings(names)
+		return names
+	case "bucket":
+		if db == nil {
+			return nil
+		}
+		var names []string
+		db.View(func(tx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				names = append(names, string(name))
+				return nil
+			})
+		})
+		return names
+	case "node-type", "thing-type":
+		return thingTypeNames(gConfig.ThingTypes)
+	case "log-level":
+		return []string{"debug", "info", "warn", "error"}
+	case "log-format":
+		return []string{"text", "json"}
+	}
+	return nil
+}
+
+// completionAppName resolves the app name from --app-name in words,
+// GWM_APP_NAME and the current context.
+func completionAppName(words []string) string {
+	for i, w := range words {
+		switch {
+		case strings.HasPrefix(w, "--app-name="):
+			return strings.TrimPrefix(w, "--app-name=")
+		case w == "--app-name" && i+1 < len(words)-1:
+			return words[i+1]
+		}
+	}
+	if v := os.Getenv("GWM_APP_NAME"); v != "" {
+		return v
+	}
+	if db == nil {
+		return ""
+	}
+	return getContext(contextApp)
+}
+
+// openCompletionDB opens the DB read only for the completion. It gives up
+// soon when another command holds the DB so that the shell doesn't hang.
+func openCompletionDB() (*DB, error) {
+	b, err := bolt.Open(dbPath(gConfig), 0600, &bolt.Options{ReadOnly: true, Timeout: 500 * time.Millisecond})
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: b}, nil
+}
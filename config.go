@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "********"
+
+// knownSites maps app-site to the host of Kii Cloud.
+var knownSites = map[string]string{
+	"us":  "api.kii.com",
+	"jp":  "api-jp.kii.com",
+	"cn3": "api-cn3.kii.com",
+	"sg":  "api-sg.kii.com",
+	"eu":  "api-eu.kii.com",
+}
+
+// refPattern matches the references to be resolved in config values.
+// ${env:NAME} is replaced with the env variable and ${file:/path} with the
+// content of the file.
+var refPattern = regexp.MustCompile(`\$\{(env|file):([^}]+)\}`)
+
+// configFiles returns the config files to be loaded. GWM_CONFIG_PATH may list
+// several files separated by the path list separator, later files override
+// earlier ones. By default ./config.yml is loaded and ./config.local.yml is
+// layered on it when exists.
+func configFiles() []string {
+	if p := os.Getenv("GWM_CONFIG_PATH"); p != "" {
+		return filepath.SplitList(p)
+	}
+	files := []string{"./config.yml"}
+	if _, err := os.Stat("./config.local.yml"); err == nil {
+		files = append(files, "./config.local.yml")
+	}
+	return files
+}
+
+// loadConfig merges files, resolves references and applies GWM_* env
+// overrides. raw is the merged config before resolving.
+func loadConfig(files []string) (conf Config, raw map[interface{}]interface{}, err error) {
+	raw = map[interface{}]interface{}{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return conf, nil, fmt.Errorf("can't read %s file. %v", f, err)
+		}
+		var m map[interface{}]interface{}
+		if err := yaml.Unmarshal(b, &m); err != nil {
+			return conf, nil, fmt.Errorf("can't unmarshal %s. %v", f, err)
+		}
+		mergeYAML(raw, m)
+	}
+	resolved, err := interpolate(raw)
+	if err != nil {
+		return conf, nil, err
+	}
+	b, err := yaml.Marshal(resolved)
+	if err != nil {
+		return conf, nil, err
+	}
+	// Unknown keys and type errors are reported after the rest is decoded
+	// so that config validate can inspect the config.
+	strictErr := yaml.UnmarshalStrict(b, &conf)
+	if _, ok := strictErr.(*yaml.TypeError); strictErr != nil && !ok {
+		return conf, nil, strictErr
+	}
+	if err := applyEnvOverrides(&conf); err != nil {
+		return conf, nil, err
+	}
+	return conf, raw, strictErr
+}
+
+// mergeYAML merges src into dst. Nested maps are merged recursively, other
+// values in src replace the ones in dst.
+func mergeYAML(dst, src map[interface{}]interface{}) {
+	for k, v := range src {
+		sm, ok1 := v.(map[interface{}]interface{})
+		dm, ok2 := dst[k].(map[interface{}]interface{})
+		if ok1 && ok2 {
+			mergeYAML(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// interpolate returns a copy of v with references resolved.
+func interpolate(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[interface{}]interface{}{}
+		for k, e := range t {
+			r, err := interpolate(e)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", k, err)
+			}
+			m[k] = r
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			r, err := interpolate(e)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = r
+		}
+		return l, nil
+	case string:
+		return resolveRefs(t)
+	}
+	return v, nil
+}
+
+func resolveRefs(s string) (interface{}, error) {
+	var rerr error
+	r := refPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		m := refPattern.FindStringSubmatch(ref)
+		v, err := resolveRef(m[1], m[2])
+		if err != nil && rerr == nil {
+			rerr = err
+		}
+		return v
+	})
+	if rerr != nil {
+		return nil, rerr
+	}
+	// Keep integers as integers so that ${env:PORT} can be used for port.
+	if r != s {
+		if n, err := strconv.Atoi(r); err == nil && strconv.Itoa(n) == r {
+			return n, nil
+		}
+	}
+	return r, nil
+}
+
+func resolveRef(kind string, name string) (string, error) {
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("env %s is not set", name)
+		}
+		return v, nil
+	case "file":
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return "", fmt.Errorf("unknown reference %s", kind)
+}
+
+// envName returns the name of the env variable overriding the field.
+// e.g. GWM_APPS_MASTER_APP_KEY for app-key of the app "master".
+func envName(path ...string) string {
+	n := "GWM_" + strings.Join(path, "_")
+	return strings.ToUpper(strings.Replace(n, "-", "_", -1))
+}
+
+// applyEnvOverrides overrides fields of conf with GWM_* env variables.
+func applyEnvOverrides(conf *Config) error {
+	str := func(p *string, path ...string) {
+		if v, ok := os.LookupEnv(envName(path...)); ok {
+			*p = v
+		}
+	}
+	str(&conf.DB, "db")
+	str(&conf.CredentialHelper, "credential-helper")
+	str(&conf.SecretKeyFile, "secret-key-file")
+	str(&conf.GatewayAddress.Host, "gateway-address", "host")
+	if v, ok := os.LookupEnv(envName("gateway-address", "port")); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", envName("gateway-address", "port"), err)
+		}
+		conf.GatewayAddress.Port = port
+	}
+	for name, addr := range conf.Gateways {
+		str(&addr.Host, "gateways", name, "host")
+		if v, ok := os.LookupEnv(envName("gateways", name, "port")); ok {
+			port, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", envName("gateways", name, "port"), err)
+			}
+			addr.Port = port
+		}
+		conf.Gateways[name] = addr
+	}
+	for name, app := range conf.Apps {
+		str(&app.ID, "apps", name, "app-id")
+		str(&app.Key, "apps", name, "app-key")
+		str(&app.Site, "apps", name, "app-site")
+		str(&app.Host, "apps", name, "app-host")
+		conf.Apps[name] = app
+	}
+	return nil
+}
+
+// redactConfig returns a copy of conf with secrets masked.
+func redactConfig(conf Config) Config {
+	apps := map[string]App{}
+	for name, app := range conf.Apps {
+		if app.Key != "" {
+			app.Key = redacted
+		}
+		apps[name] = app
+	}
+	conf.Apps = apps
+	return conf
+}
+
+// redactRawConfig returns a copy of raw with literal secrets masked.
+// References are kept as they don't reveal the secret.
+func redactRawConfig(raw map[interface{}]interface{}) map[interface{}]interface{} {
+	m := map[interface{}]interface{}{}
+	for k, v := range raw {
+		m[k] = v
+	}
+	apps, ok := raw["apps"].(map[interface{}]interface{})
+	if !ok {
+		return m
+	}
+	rapps := map[interface{}]interface{}{}
+	for name, v := range apps {
+		app, ok := v.(map[interface{}]interface{})
+		if !ok {
+			rapps[name] = v
+			continue
+		}
+		rapp := map[interface{}]interface{}{}
+		for k, e := range app {
+			if s, ok := e.(string); k == "app-key" && (!ok || !refPattern.MatchString(s)) {
+				e = redacted
+			}
+			rapp[k] = e
+		}
+		rapps[name] = rapp
+	}
+	m["apps"] = rapps
+	return m
+}
+
+// mustApp returns the app named appName. It exits when the app is not
+// configured.
+func mustApp(appName string) App {
+	if appName == "" {
+		stdLog.Fatalln("no app-name is specified")
+	}
+	app, ok := gConfig.Apps[appName]
+	if !ok {
+		stdLog.Fatalf("app %q is not configured. available apps: %s\n", appName, strings.Join(appNames(gConfig.Apps), ", "))
+	}
+	return app
+}
+
+// appNames returns the names of apps in sorted order.
+func appNames(apps map[string]App) []string {
+	var names []string
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gatewayNames returns the names of gateways in sorted order.
+func gatewayNames(gateways map[string]GatewayAddress) []string {
+	var names []string
+	for name := range gateways {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateConfig checks conf statically and returns the problems found.
+// files are checked for unknown keys. loadErr is the error of loadConfig.
+func validateConfig(conf Config, files []string, loadErr error) []string {
+	problems := unknownKeys(files)
+	if te, ok := loadErr.(*yaml.TypeError); ok {
+		for _, e := range te.Errors {
+			// Unknown keys are reported with the file by unknownKeys.
+			if !strings.Contains(e, "not found in type") {
+				problems = append(problems, e)
+			}
+		}
+	} else if loadErr != nil {
+		problems = append(problems, loadErr.Error())
+	}
+	if len(conf.Apps) == 0 {
+		problems = append(problems, "no app is configured")
+	}
+	for _, name := range appNames(conf.Apps) {
+		app := conf.Apps[name]
+		if app.ID == "" {
+			problems = append(problems, fmt.Sprintf("apps.%s: app-id is empty", name))
+		}
+		if app.Key == "" {
+			problems = append(problems, fmt.Sprintf("apps.%s: app-key is empty", name))
+		}
+		if app.Host != "" {
+			if !validHost(app.Host) {
+				problems = append(problems, fmt.Sprintf("apps.%s: app-host %q is not a valid host", name, app.Host))
+			}
+		} else if _, ok := knownSites[app.Site]; !ok {
+			problems = append(problems, fmt.Sprintf("apps.%s: app-site %q is unknown and app-host is not given", name, app.Site))
+		}
+	}
+	problems = append(problems, validateGatewayAddress("gateway-address", conf.GatewayAddress)...)
+	for _, name := range gatewayNames(conf.Gateways) {
+		if name == defaultGateway {
+			problems = append(problems, fmt.Sprintf("gateways.%s: %s is reserved for gateway-address", name, name))
+		}
+		problems = append(problems, validateGatewayAddress("gateways."+name, conf.Gateways[name])...)
+	}
+	if conf.Log.Level != "" {
+		if _, err := logrus.ParseLevel(conf.Log.Level); err != nil {
+			problems = append(problems, fmt.Sprintf("log: %v", err))
+		}
+	}
+	if f := conf.Log.Format; f != "" && f != "text" && f != "json" {
+		problems = append(problems, fmt.Sprintf("log: unknown format %q", f))
+	}
+	problems = append(problems, validateHTTPTarget("http.gateway", conf.HTTP.Gateway)...)
+	problems = append(problems, validateHTTPTarget("http.cloud", conf.HTTP.Cloud)...)
+	problems = append(problems, validateThingTypes(conf.ThingTypes)...)
+	if err := checkWritable(dbPath(conf)); err != nil {
+		problems = append(problems, fmt.Sprintf("db: %v", err))
+	}
+	return problems
+}
+
+func validateGatewayAddress(path string, addr GatewayAddress) []string {
+	var problems []string
+	if !validHost(addr.Host) {
+		problems = append(problems, fmt.Sprintf("%s: host %q is not a valid host", path, addr.Host))
+	}
+	if addr.Port <= 0 || 65535 < addr.Port {
+		problems = append(problems, fmt.Sprintf("%s: port %d is out of range", path, addr.Port))
+	}
+	return problems
+}
+
+func validateHTTPTarget(path string, t HTTPTarget) []string {
+	var problems []string
+	if t.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("%s: timeout %v is negative", path, t.Timeout))
+	}
+	if t.Retries != nil && *t.Retries < 0 {
+		problems = append(problems, fmt.Sprintf("%s: retries %d is negative", path, *t.Retries))
+	}
+	if t.Backoff < 0 || t.MaxBackoff < 0 {
+		problems = append(problems, fmt.Sprintf("%s: backoff is negative", path))
+	}
+	return problems
+}
+
+func validHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, "/ ") {
+		return false
+	}
+	u, err := url.Parse("http://" + host)
+	return err == nil && u.Hostname() != ""
+}
+
+// checkWritable checks the file at path can be written, or created when not
+// exists.
+func checkWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err == nil {
+		return f.Close()
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".gwm-check")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// dbPath returns the path of the bolt DB file.
+func dbPath(conf Config) string {
+	if conf.DB == "" {
+		return "manager.db"
+	}
+	return conf.DB
+}
+
+// unknownKeys returns the keys in files which are not known to Config.
+func unknownKeys(files []string) []string {
+	var problems []string
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		var strict Config
+		err = yaml.UnmarshalStrict(b, &strict)
+		te, ok := err.(*yaml.TypeError)
+		if !ok {
+			continue
+		}
+		for _, e := range te.Errors {
+			// Type errors are expected for references such as port: ${env:PORT}.
+			if strings.Contains(e, "not found in type") {
+				problems = append(problems, f+": "+e)
+			}
+		}
+	}
+	return problems
+}
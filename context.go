@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/codegangsta/cli"
+)
+
+// Keys of the context bucket.
+const (
+	contextApp     = "app"
+	contextGateway = "gateway"
+	// contextUser is followed by the app name.
+	contextUser = "user:"
+)
+
+// defaultGateway is the name of gateway-address in the config file.
+const defaultGateway = "default"
+
+// resolveAppName resolves the app name in the following order: --app-name of
+// the command, global --app-name, GWM_APP_NAME and the current context.
+// source tells where the name comes from.
+func resolveAppName(c *cli.Context) (name string, source string) {
+	if v := c.String("app-name"); v != "" {
+		return v, "--app-name"
+	}
+	if v := c.GlobalString("app-name"); v != "" {
+		return v, "global --app-name or GWM_APP_NAME"
+	}
+	if v := getContext(contextApp); v != "" {
+		return v, "context"
+	}
+	return "", ""
+}
+
+// appNameOf returns the app name resolved by resolveAppName.
+func appNameOf(c *cli.Context) string {
+	name, _ := resolveAppName(c)
+	return name
+}
+
+// resolveUser resolves the user name of the app in the following order:
+// --user of the command, global --user, GWM_USER and the current context.
+// It is empty when none is given, to use the only user of the app.
+func resolveUser(c *cli.Context, appName string) (name string, source string) {
+	if v := c.String("user"); v != "" {
+		return v, "--user"
+	}
+	if v := c.GlobalString("user"); v != "" {
+		return v, "global --user or GWM_USER"
+	}
+	if v := getContext(contextUser + appName); v != "" {
+		return v, "context"
+	}
+	return "", ""
+}
+
+// mustUser returns the stored user resolved by resolveUser. It exits when the
+// user is not stored.
+func mustUser(c *cli.Context, appName string) User {
+	name, _ := resolveUser(c, appName)
+	user, err := storedUser(appName, name)
+	if err != nil {
+		stdLog.Fatalln(err)
+	}
+	return user
+}
+
+// resolveGateway resolves the gateway in the following order: global
+// --gateway, GWM_GATEWAY, the current context and gateway-address in the
+// config file.
+func resolveGateway(c *cli.Context) (name string, source string) {
+	if v := c.GlobalString("gateway"); v != "" {
+		return v, "global --gateway or GWM_GATEWAY"
+	}
+	if v := getContext(contextGateway); v != "" {
+		return v, "context"
+	}
+	return defaultGateway, "gateway-address"
+}
+
+// gatewayAddress returns the address of the resolved gateway. It exits when
+// the gateway is not configured.
+func gatewayAddress(c *cli.Context) GatewayAddress {
+	name, _ := resolveGateway(c)
+	return mustGateway(name)
+}
+
+// mustGateway returns the address of the gateway named name. It exits when the
+// gateway is not configured.
+func mustGateway(name string) GatewayAddress {
+	if name == defaultGateway {
+		return gConfig.GatewayAddress
+	}
+	addr, ok := gConfig.Gateways[name]
+	if !ok {
+		stdLog.Fatalf("gateway %q is not configured. available gateways: %s\n", name, strings.Join(gatewayNames(gConfig.Gateways), ", "))
+	}
+	return addr
+}
+
+func getContext(key string) string {
+	var v string
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("context"))
+		v = string(b.Get([]byte(key)))
+		return nil
+	})
+	return v
+}
+
+// setContext stores value as key of the current context. Empty value removes
+// the key.
+func setContext(key string, value string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("context"))
+		if value == "" {
+			return b.Delete([]byte(key))
+		}
+		return b.Put([]byte(key), []byte(value))
+	})
+}
+
+// gatewayKey returns the key of tokens and gateway-ids buckets for the app on
+// the resolved gateway.
+func gatewayKey(c *cli.Context, appName string) string {
+	name, _ := resolveGateway(c)
+	return gatewayKeyOf(appName, name)
+}
+
+// gatewayKeyOf returns "<app name>@<gateway name>". The app name is used as is
+// for gateway-address to keep DBs created before named gateways working.
+func gatewayKeyOf(appName string, gatewayName string) string {
+	if gatewayName == defaultGateway {
+		return appName
+	}
+	return appName + "@" + gatewayName
+}
+
+// splitGatewayKey splits the key returned by gatewayKeyOf.
+func splitGatewayKey(gwKey string) (appName string, gatewayName string) {
+	i := strings.LastIndex(gwKey, "@")
+	if i < 0 {
+		return gwKey, defaultGateway
+	}
+	return gwKey[:i], gwKey[i+1:]
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Kinds of secret asked to the credential helper.
+const (
+	secretKiiUser      = "kii-user"
+	secretGatewayAdmin = "gateway-admin"
+	secretGatewayThing = "gateway-thing"
+	secretNode         = "node"
+	secretExport       = "export"
+)
+
+// secretFlagNames are the names of flags giving secrets. They are redacted
+// in audit records.
+var secretFlagNames = map[string]bool{}
+
+// secretFlags returns the flags giving the secret named name:
+// --<name>, --<name>-file and --<name>-stdin.
+func secretFlags(name string, usage string) []cli.Flag {
+	secretFlagNames[name] = true
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  name,
+			Usage: usage + ". Visible in shell history and ps, prefer --" + name + "-file or the prompt.",
+		},
+		cli.StringFlag{
+			Name:  name + "-file",
+			Usage: "read " + name + " from the file",
+		},
+		cli.BoolFlag{
+			Name:  name + "-stdin",
+			Usage: "read " + name + " from the first line of stdin",
+		},
+	}
+}
+
+// joinFlags concatenates lists of flags.
+func joinFlags(lists ...[]cli.Flag) []cli.Flag {
+	var flags []cli.Flag
+	for _, l := range lists {
+		flags = append(flags, l...)
+	}
+	return flags
+}
+
+// readSecret resolves the secret named name. Sources are tried in the
+// following order: --<name>, --<name>-file, --<name>-stdin, the password
+// stored by --generate-password for end-nodes, the credential helper and
+// finally a no-echo prompt on the terminal.
+func readSecret(c *cli.Context, name string, kind string, appName string, key string) (string, error) {
+	if v := c.String(name); v != "" {
+		return v, nil
+	}
+	if path := c.String(name + "-file"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if c.Bool(name + "-stdin") {
+		return readLine(os.Stdin)
+	}
+	if kind == secretNode {
+		v, err := storedNodePassword(appName, key)
+		if err != nil {
+			return "", err
+		}
+		if v != "" {
+			return v, nil
+		}
+	}
+	if helper := credentialHelper(c); helper != "" {
+		v, err := helperGet(helper, kind, appName, key)
+		if err != nil {
+			return "", err
+		}
+		if v != "" {
+			return v, nil
+		}
+	}
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", fmt.Errorf("no %s is specified", name)
+	}
+	fmt.Fprintf(os.Stderr, "%s (%s %s): ", name, kind, key)
+	b, err := readPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(b) == 0 {
+		return "", fmt.Errorf("no %s is specified", name)
+	}
+	return string(b), nil
+}
+
+// readPassword reads a password without echo. It returns when gCtx is
+// canceled with the terminal restored.
+func readPassword(fd int) ([]byte, error) {
+	state, err := terminal.GetState(fd)
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		b   []byte
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		b, err := terminal.ReadPassword(fd)
+		ch <- result{b, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.b, r.err
+	case <-gCtx.Done():
+		terminal.Restore(fd, state)
+		return nil, gCtx.Err()
+	}
+}
+
+func readLine(r io.Reader) (string, error) {
+	line, err := readRawLine(r)
+	if err != nil {
+		return "", err
+	}
+	if line == "" {
+		return "", errors.New("no secret is given to stdin")
+	}
+	return line, nil
+}
+
+// readRawLine reads a line from r without the line break. It reads one byte
+// at a time so that nothing after the line is consumed from stdin, which is
+// shared by the following prompts and the shell.
+func readRawLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(line), "\r"), nil
+}
+
+// credentialHelper returns the helper command given by the global flag or
+// the config file.
+func credentialHelper(c *cli.Context) string {
+	if h := c.GlobalString("credential-helper"); h != "" {
+		return h
+	}
+	return gConfig.CredentialHelper
+}
+
+// helperGet asks the secret to the credential helper in the same manner as
+// git-credential. The helper is executed with "get" as the last argument and
+// receives the following attributes on stdin:
+//
+//	kind=<kii-user|gateway-admin|gateway-thing|node>
+//	app=<app name>
+//	key=<user name, gateway thing id or vendor thing id>
+//
+// It should print "password=<secret>" to stdout, or nothing when it doesn't
+// know the secret.
+func helperGet(helper string, kind string, appName string, key string) (string, error) {
+	args := strings.Fields(helper)
+	if len(args) == 0 {
+		return "", nil
+	}
+	cmd := exec.Command(args[0], append(args[1:], "get")...)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("kind=%s\napp=%s\nkey=%s\n\n", kind, appName, key))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("credential helper %s failed: %v", args[0], err)
+	}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), "=", 2)
+		if len(kv) == 2 && kv[0] == "password" {
+			return kv[1], nil
+		}
+	}
+	return "", s.Err()
+}
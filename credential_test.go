@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestReadLineKeepsRest checks that reading a secret leaves the following
+// lines for the next prompts, e.g. per end-node passwords piped to stdin.
+func TestReadLineKeepsRest(t *testing.T) {
+	r := strings.NewReader("pass1\r\npass2\npass3")
+	for _, want := range []string{"pass1", "pass2", "pass3"} {
+		got, err := readLine(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("readLine() = %q, want %q", got, want)
+		}
+	}
+	if _, err := readLine(r); err == nil {
+		t.Error("readLine() at EOF succeeded")
+	}
+}
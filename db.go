@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// storedGatewayID returns the gateway thing id stored by onboard-gateway.
+func storedGatewayID(gwKey string) string {
+	var id string
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("gateway-ids"))
+		id = string(b.Get([]byte(gwKey)))
+		return nil
+	})
+	return id
+}
+
+// storedToken returns the token of the gateway local rest api stored by auth.
+func storedToken(gwKey string) string {
+	var token string
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tokens"))
+		token = string(b.Get([]byte(gwKey)))
+		return nil
+	})
+	return token
+}
+
+// userKeyOf returns the key of the users bucket, "<app name>/<user name>".
+// DBs created before multiple users keep one user keyed by the app name.
+func userKeyOf(appName string, username string) string {
+	return appName + "/" + username
+}
+
+// storedUsers returns the users of the app stored by user-login keyed by
+// user name. The user stored by older versions has an empty user name.
+func storedUsers(appName string) (users map[string]User, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		users, err = getUsers(tx, appName)
+		return err
+	})
+	return users, err
+}
+
+// getUsers returns the users of the app in tx, as storedUsers.
+func getUsers(tx *bolt.Tx, appName string) (map[string]User, error) {
+	users := map[string]User{}
+	b := tx.Bucket([]byte("users"))
+	if v := b.Get([]byte(appName)); v != nil {
+		var user User
+		if err := json.Unmarshal(v, &user); err != nil {
+			return nil, err
+		}
+		users[""] = user
+	}
+	prefix := []byte(userKeyOf(appName, ""))
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var user User
+		if err := json.Unmarshal(v, &user); err != nil {
+			return nil, err
+		}
+		users[string(k[len(prefix):])] = user
+	}
+	return users, nil
+}
+
+// storedUser returns the user of the app stored by user-login. When username
+// is empty, the only user of the app is returned.
+func storedUser(appName string, username string) (User, error) {
+	users, err := storedUsers(appName)
+	if err != nil {
+		return User{}, err
+	}
+	if username != "" {
+		user, ok := users[username]
+		if !ok {
+			return User{}, fmt.Errorf("user %s is not logged in to %s. execute user-login", username, appName)
+		}
+		return user, nil
+	}
+	switch len(users) {
+	case 0:
+		return User{}, errors.New("no login user. execute user-login")
+	case 1:
+		for _, user := range users {
+			return user, nil
+		}
+	}
+	return User{}, fmt.Errorf("several users are logged in to %s. select one by --user or user use", appName)
+}
+
+// storeUser stores the user logged in. The user stored by older versions is
+// replaced when it is the same user.
+func storeUser(appName string, user User) error {
+	j, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		var legacy User
+		if v := b.Get([]byte(appName)); v != nil && json.Unmarshal(v, &legacy) == nil && legacy.ID == user.ID {
+			if err := b.Delete([]byte(appName)); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte(userKeyOf(appName, user.Username)), j)
+	})
+}
+
+// deleteUser removes the user. An empty username removes the user stored by
+// older versions.
+func deleteUser(appName string, username string) error {
+	key := appName
+	if username != "" {
+		key = userKeyOf(appName, username)
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("users")).Delete([]byte(key))
+	})
+}
+
+// storedNodes returns end-nodes stored in the nodes:<app> bucket keyed by
+// vendor thing id.
+func storedNodes(appName string) (map[string]Node, error) {
+	records, err := storedNodeRecords(appName)
+	nodes := map[string]Node{}
+	for vid, r := range records {
+		nodes[vid] = r.Node()
+	}
+	return nodes, err
+}
+
+// storedNodeRecords returns the records in the nodes:<app> bucket keyed by
+// vendor thing id.
+func storedNodeRecords(appName string) (map[string]NodeRecord, error) {
+	records := map[string]NodeRecord{}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("nodes:" + appName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			records[string(k)] = decodeNodeRecord(k, v)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// gatewayNodes returns the end-nodes of the app recorded under the gateway
+// keyed by vendor thing id. unassigned are the end-nodes recorded without a
+// gateway, e.g. by older versions, which may belong to any gateway of the app.
+func gatewayNodes(appName string, gatewayID string) (nodes map[string]Node, unassigned map[string]Node, err error) {
+	records, err := storedNodeRecords(appName)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes, unassigned = map[string]Node{}, map[string]Node{}
+	for vid, r := range records {
+		switch r.Gateway {
+		case "":
+			unassigned[vid] = r.Node()
+		case gatewayID:
+			nodes[vid] = r.Node()
+		}
+	}
+	return nodes, unassigned, nil
+}
+
+// storedNodeRecord returns the record of the end-node given by vendor thing
+// id or thing id, nil when it is not found.
+func storedNodeRecord(appName string, vidOrID string) (*NodeRecord, error) {
+	var r *NodeRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		r = getNodeRecord(tx, appName, vidOrID)
+		if r != nil {
+			return nil
+		}
+		if idx := tx.Bucket([]byte("node-ids:" + appName)); idx != nil {
+			if vid := idx.Get([]byte(vidOrID)); vid != nil {
+				r = getNodeRecord(tx, appName, string(vid))
+				return nil
+			}
+		}
+		// Records stored before the index are not indexed.
+		b := tx.Bucket([]byte("nodes:" + appName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if rec := decodeNodeRecord(k, v); rec.ThingID == vidOrID {
+				r = &rec
+			}
+			return nil
+		})
+	})
+	return r, err
+}
+
+// decodeNodeRecord decodes the value of the nodes:<app> bucket. Values stored
+// before the records are the bare thing id.
+func decodeNodeRecord(vid []byte, v []byte) NodeRecord {
+	var r NodeRecord
+	if err := json.Unmarshal(v, &r); err != nil || r.ThingID == "" {
+		return NodeRecord{ThingID: string(v), VID: string(vid)}
+	}
+	r.VID = string(vid)
+	return r
+}
+
+// getNodeRecord returns the record of the end-node in tx, nil when it is not
+// found.
+func getNodeRecord(tx *bolt.Tx, appName string, vid string) *NodeRecord {
+	b := tx.Bucket([]byte("nodes:" + appName))
+	if b == nil {
+		return nil
+	}
+	v := b.Get([]byte(vid))
+	if v == nil {
+		return nil
+	}
+	r := decodeNodeRecord([]byte(vid), v)
+	return &r
+}
+
+// putNodeRecord stores the record keyed by its vendor thing id in tx and
+// indexes it by thing id in the node-ids:<app> bucket.
+func putNodeRecord(tx *bolt.Tx, appName string, r NodeRecord) error {
+	b, err := tx.CreateBucketIfNotExists([]byte("nodes:" + appName))
+	if err != nil {
+		return err
+	}
+	idx, err := tx.CreateBucketIfNotExists([]byte("node-ids:" + appName))
+	if err != nil {
+		return err
+	}
+	if old := getNodeRecord(tx, appName, r.VID); old != nil && old.ThingID != r.ThingID {
+		if err := idx.Delete([]byte(old.ThingID)); err != nil {
+			return err
+		}
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(r.VID), v); err != nil {
+		return err
+	}
+	return idx.Put([]byte(r.ThingID), []byte(r.VID))
+}
+
+// deleteNodeRecord removes the record of the end-node and its index in tx.
+func deleteNodeRecord(tx *bolt.Tx, appName string, vid string) error {
+	r := getNodeRecord(tx, appName, vid)
+	if r == nil {
+		return nil
+	}
+	if idx := tx.Bucket([]byte("node-ids:" + appName)); idx != nil {
+		if err := idx.Delete([]byte(r.ThingID)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte("nodes:" + appName)).Delete([]byte(vid))
+}
+
+// updateNodeRecord applies f to the record of the end-node and stores it.
+// A record is created when it is not found.
+func updateNodeRecord(appName string, vid string, f func(r *NodeRecord)) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		r := getNodeRecord(tx, appName, vid)
+		if r == nil {
+			r = &NodeRecord{VID: vid}
+		}
+		f(r)
+		return putNodeRecord(tx, appName, *r)
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+)
+
+// DB is the bolt DB. With DryRun, it is a temporary copy of the DB file and
+// writes are printed. They are committed only to the copy, so the following
+// steps see them in the same manner as the real execution.
+type DB struct {
+	*bolt.DB
+	DryRun bool
+}
+
+// openDB opens the DB file and creates buckets. With dryRun, the file is
+// opened read-only and copied to a temporary file so that nothing is written
+// to it. A missing file is not created, the dry-run starts from an empty DB.
+func openDB(path string, dryRun bool) (*DB, error) {
+	if !dryRun {
+		b, err := bolt.Open(path, 0600, nil)
+		if err != nil {
+			return nil, err
+		}
+		return newDB(b, false)
+	}
+	tmp, err := ioutil.TempFile("", "gwm-dry-run-")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	if _, err := os.Stat(path); err == nil {
+		b, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+		if err != nil {
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+		err = b.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(tmp.Name(), 0600)
+		})
+		b.Close()
+		if err != nil {
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	b, err := bolt.Open(tmp.Name(), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The copy is not needed after exit, even by a fatal error. Removing
+	// the open file fails on Windows, Close removes it again.
+	os.Remove(tmp.Name())
+	return newDB(b, true)
+}
+
+func newDB(b *bolt.DB, dryRun bool) (*DB, error) {
+	d := &DB{DB: b}
+	err := d.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"tokens", "gateway-ids", "users", "context", "setup", "gateway-replacements", "audit"} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	d.DryRun = dryRun
+	return d, err
+}
+
+// Close closes the DB and removes the temporary copy made by dry-run.
+func (d *DB) Close() error {
+	path := d.Path()
+	err := d.DB.Close()
+	if d.DryRun {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Update executes fn in a read-write transaction. With DryRun, the entries
+// changed by fn are printed.
+func (d *DB) Update(fn func(*bolt.Tx) error) error {
+	if !d.DryRun {
+		return d.DB.Update(fn)
+	}
+	var before map[string]map[string]string
+	d.DB.View(func(tx *bolt.Tx) error {
+		before = dumpTx(tx)
+		return nil
+	})
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		printWrites(before, dumpTx(tx))
+		return nil
+	})
+}
+
+func dumpTx(tx *bolt.Tx) map[string]map[string]string {
+	m := map[string]map[string]string{}
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		entries := map[string]string{}
+		b.ForEach(func(k, v []byte) error {
+			entries[string(k)] = string(v)
+			return nil
+		})
+		m[string(name)] = entries
+		return nil
+	})
+	return m
+}
+
+func printWrites(before map[string]map[string]string, after map[string]map[string]string) {
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := after[name]; !ok {
+			stdLog.Printf("dry-run: db delete-bucket %s\n", name)
+			continue
+		}
+		if _, ok := before[name]; !ok {
+			stdLog.Printf("dry-run: db create-bucket %s\n", name)
+		}
+		var keys []string
+		for k := range before[name] {
+			keys = append(keys, k)
+		}
+		for k := range after[name] {
+			if _, ok := before[name][k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v, ok := after[name][k]
+			switch {
+			case !ok:
+				stdLog.Printf("dry-run: db delete %s/%s\n", name, printableKey(k))
+			case v != before[name][k]:
+				stdLog.Printf("dry-run: db put %s/%s %s\n", name, printableKey(k), redactValue(name, v))
+			}
+		}
+	}
+}
+
+// printableKey returns k in hex when it is binary, e.g. the sequence of the
+// audit bucket.
+func printableKey(k string) string {
+	for _, r := range k {
+		if !unicode.IsPrint(r) {
+			return fmt.Sprintf("%x", k)
+		}
+	}
+	return k
+}
+
+// redactValue redacts the value stored in the bucket for printing.
+func redactValue(bucket string, v string) string {
+	if bucket == "tokens" {
+		return redacted
+	}
+	return redactBody([]byte(v))
+}
+
+// redactBody redacts passwords and tokens of a JSON body. Other bodies are
+// returned as is.
+func redactBody(b []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(b)
+	}
+	r, _ := json.Marshal(redactJSON(v))
+	return string(r)
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if secretKey(k) {
+				t[k] = redacted
+			} else {
+				t[k] = redactJSON(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = redactJSON(e)
+		}
+	}
+	return v
+}
+
+func secretKey(k string) bool {
+	k = strings.ToLower(k)
+	return strings.Contains(k, "password") || strings.Contains(k, "token") || strings.Contains(k, "secret")
+}
+
+// dryRunResponse is the body returned by dryRunTransport to requests other
+// than GET. It has the ids read from the responses of Gateway Agent and Kii
+// Cloud so that the following steps can be printed.
+const dryRunResponse = `{"accessToken":"DRY-RUN","access_token":"DRY-RUN","id":"DRY-RUN","userID":"DRY-RUN","thingID":"DRY-RUN","endNodeThingID":"DRY-RUN","commandID":"DRY-RUN"}`
+
+// dryRunGetResponse is the body returned to GET requests. It has an empty
+// list and the user id looked up by owner add.
+const dryRunGetResponse = `{"results":[],"userID":"DRY-RUN"}`
+
+// dryRunTransport prints requests instead of sending them. GET requests are
+// answered with an empty result.
+type dryRunTransport struct{}
+
+func (t dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	stdLog.Printf("dry-run: %s %s %s\n", req.Method, req.URL, redactBody(body))
+	resp := dryRunResponse
+	if req.Method == "GET" {
+		resp = dryRunGetResponse
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(resp))),
+		ContentLength: int64(len(resp)),
+		Request:       req,
+	}, nil
+}
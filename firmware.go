@@ -0,0 +1,621 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/codegangsta/cli"
+)
+
+// Campaign is a firmware update campaign stored in the campaigns:<app>
+// bucket keyed by its name.
+type Campaign struct {
+	Name          string         `json:"name"`
+	TargetVersion string         `json:"targetVersion"`
+	ThingType     string         `json:"thingType,omitempty"`
+	StartedAt     time.Time      `json:"startedAt"`
+	Nodes         []CampaignNode `json:"nodes"`
+}
+
+// CampaignNode is an end-node in a campaign.
+type CampaignNode struct {
+	VID         string `json:"vid"`
+	ThingID     string `json:"thingID"`
+	FromVersion string `json:"fromVersion"`
+	CommandID   string `json:"commandID,omitempty"`
+	// State is posting until the command is posted, post-failed, the
+	// command state on Kii Cloud, or updated when the firmware version
+	// reaches the target.
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// Campaign node states other than the command states of Kii Cloud.
+const (
+	stateUpdated    = "updated"
+	statePostFailed = "post-failed"
+	// statePosting is left when start is interrupted before the command is
+	// posted, or before its command id is stored. status makes it
+	// post-failed.
+	statePosting = "posting"
+)
+
+// finished tells whether the node needs no more tracking.
+func (n CampaignNode) finished() bool {
+	switch n.State {
+	case stateUpdated, statePostFailed, "SEND_FAILED", "INCOMPLETE":
+		return true
+	}
+	return false
+}
+
+// compareVersions compares dot or dash separated versions. Numeric parts
+// are compared as numbers, others as strings.
+func compareVersions(a string, b string) int {
+	split := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool { return r == '.' || r == '-' })
+	}
+	pa, pb := split(a), split(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		if i >= len(pa) {
+			return -1
+		}
+		if i >= len(pb) {
+			return 1
+		}
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		switch {
+		case errA == nil && errB == nil && na != nb:
+			if na < nb {
+				return -1
+			}
+			return 1
+		case (errA != nil || errB != nil) && pa[i] != pb[i]:
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+var firmwareCommand = cli.Command{
+	Name:  "firmware",
+	Usage: "firmware list | firmware set | firmware campaign start|status|list",
+	UsageText: `Track and update firmware versions of end-nodes. The versions are recorded by
+	onboard-node --node-fv, firmware list --refresh and firmware set.`,
+	Subcommands: []cli.Command{
+		{
+			Name:      "list",
+			Usage:     "list [--refresh] [--json] --app-name <app name>",
+			UsageText: "List end-nodes grouped by thing type and firmware version.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "app-name",
+				},
+				userFlag,
+				cli.BoolFlag{
+					Name:  "refresh",
+					Usage: "Fetch thing types and firmware versions from Kii Cloud before listing",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the records per end-node in JSON",
+				},
+			},
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				app := mustApp(appName)
+				if c.Bool("refresh") {
+					refreshFirmware(appName, app, mustUser(c, appName))
+				}
+				records, err := storedNodeRecords(appName)
+				if err != nil {
+					stdLog.Fatalln("failed to read end-nodes from db: ", err)
+				}
+				if c.Bool("json") {
+					b, _ := json.MarshalIndent(records, "", "  ")
+					fmt.Println(string(b))
+					return
+				}
+				groups := map[[2]string][]string{}
+				for vid, r := range records {
+					key := [2]string{orUnknown(r.ThingType), orUnknown(r.Firmware)}
+					groups[key] = append(groups[key], vid)
+				}
+				var keys [][2]string
+				for k := range groups {
+					keys = append(keys, k)
+				}
+				sort.Slice(keys, func(i, j int) bool {
+					if keys[i][0] != keys[j][0] {
+						return keys[i][0] < keys[j][0]
+					}
+					return compareVersions(keys[i][1], keys[j][1]) < 0
+				})
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "THING TYPE\tVERSION\tCOUNT\tEND-NODES")
+				for _, k := range keys {
+					vids := groups[k]
+					sort.Strings(vids)
+					fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", k[0], k[1], len(vids), strings.Join(vids, ","))
+				}
+				w.Flush()
+			},
+		},
+		{
+			Name:      "set",
+			Usage:     "set --version <version> (--node-vid <vid> ... | --thing-type <thing type> | --all) --app-name <app name>",
+			UsageText: "Update the firmware version of the end-nodes on Kii Cloud.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "app-name",
+				},
+				userFlag,
+				cli.StringFlag{
+					Name:  "version",
+					Usage: "Firmware version to set",
+				},
+				cli.StringSliceFlag{
+					Name:  "node-vid",
+					Usage: "Vendor thing id of the end-node. Can be repeated",
+				},
+				cli.StringFlag{
+					Name:  "thing-type",
+					Usage: "Select the end-nodes of the thing type",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "Select all the end-nodes of the app",
+				},
+			},
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				app := mustApp(appName)
+				version := c.String("version")
+				if version == "" {
+					stdLog.Fatalln("no version is specified")
+				}
+				user := mustUser(c, appName)
+				selected := selectNodes(c, appName)
+				a := startAudit(c, "firmware-set")
+				a.Target(version)
+				failed := 0
+				for _, n := range selected {
+					err := _updateFirmwareVersion(gCtx, app, user, n.ID, version)
+					if err == nil {
+						err = updateNodeRecord(appName, n.VID, func(r *NodeRecord) { r.Firmware = version })
+					}
+					if err != nil {
+						failed++
+						fmt.Printf("  failed %s: %v\n", n.VID, err)
+						continue
+					}
+					fmt.Printf("  done   %s\n", n.VID)
+					stepCompleted("firmware-set " + n.VID)
+				}
+				if failed > 0 {
+					a.Fatal(failed, " end-node(s) failed")
+				}
+				a.Done()
+			},
+		},
+		{
+			Name:  "campaign",
+			Usage: "campaign start|status|list",
+			Subcommands: []cli.Command{
+				campaignStart,
+				campaignStatus,
+				{
+					Name:  "list",
+					Usage: "list --app-name <app name>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "app-name",
+						},
+					},
+					Action: func(c *cli.Context) {
+						appName := appNameOf(c)
+						mustApp(appName)
+						campaigns, err := storedCampaigns(appName)
+						if err != nil {
+							stdLog.Fatalln("failed to read campaigns from db: ", err)
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+						fmt.Fprintln(w, "NAME\tTARGET\tTHING TYPE\tSTARTED\tUPDATED\tFAILED\tTOTAL")
+						for _, cp := range campaigns {
+							updated, failed := cp.counts()
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n", cp.Name, cp.TargetVersion, orUnknown(cp.ThingType),
+								cp.StartedAt.Format(time.RFC3339), updated, failed, len(cp.Nodes))
+						}
+						w.Flush()
+					},
+				},
+			},
+		},
+	},
+}
+
+var campaignStart = cli.Command{
+	Name:  "start",
+	Usage: "start --name <campaign name> --target-version <version> [--thing-type <thing type>] [--include-unknown] --command-file <filename> --app-name <app name>",
+	UsageText: `Post the firmware update command to the end-nodes below the target version.
+	{{version}} in the command file is replaced with the target version.
+	Without --thing-type, the end-nodes must be of a single thing type. End-nodes of unknown
+	thing type or firmware version are skipped unless --include-unknown is given.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "app-name",
+		},
+		userFlag,
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "Name of the campaign to refer by status",
+		},
+		cli.StringFlag{
+			Name:  "target-version",
+			Usage: "Firmware version the end-nodes are updated to",
+		},
+		cli.StringFlag{
+			Name:  "thing-type",
+			Usage: "Select the end-nodes of the thing type",
+		},
+		cli.BoolFlag{
+			Name:  "include-unknown",
+			Usage: "Include the end-nodes of unknown thing type or firmware version. Execute firmware list --refresh to know them",
+		},
+		cli.StringFlag{
+			Name:  "command-file",
+			Usage: "file path describes the firmware update command in json format, the same as post-command",
+		},
+	},
+	Action: func(c *cli.Context) {
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		name, target := c.String("name"), c.String("target-version")
+		if name == "" || target == "" {
+			stdLog.Fatalln("--name and --target-version are required")
+		}
+		b, err := ioutil.ReadFile(c.String("command-file"))
+		if err != nil {
+			stdLog.Fatalln("can not read command-file: ", err)
+		}
+		command := []byte(strings.Replace(string(b), "{{version}}", target, -1))
+		if existing, _ := storedCampaign(appName, name); existing != nil {
+			stdLog.Fatalf("campaign %s already exists. check it by firmware campaign status %s\n", name, name)
+		}
+		user := mustUser(c, appName)
+		records, err := storedNodeRecords(appName)
+		if err != nil {
+			stdLog.Fatalln("failed to read end-nodes from db: ", err)
+		}
+		cp := Campaign{Name: name, TargetVersion: target, StartedAt: time.Now()}
+		vids, unknown, thingType, err := campaignNodes(records, c.String("thing-type"), target, c.Bool("include-unknown"))
+		if len(unknown) > 0 {
+			stdLog.Warnf("%d end-node(s) of unknown thing type or firmware version are skipped: %v. specify --include-unknown to include them.\n", len(unknown), unknown)
+		}
+		if err != nil {
+			stdLog.Fatalln(err)
+		}
+		cp.ThingType = thingType
+		if len(vids) == 0 {
+			fmt.Println("no end-node is below", target)
+			return
+		}
+
+		traits, command, err := campaignCommand(cp.ThingType, command)
+		if err != nil {
+			stdLog.Fatalln("can not parse command-file: ", err)
+		}
+		post := _postCommand
+		if traits {
+			post = _postTraitCommand
+		}
+
+		a := startAudit(c, "firmware-campaign")
+		a.Target(name)
+		// The campaign is stored before posting and after each end-node so
+		// that status tracks the commands posted even when start is
+		// interrupted.
+		for _, vid := range vids {
+			cp.Nodes = append(cp.Nodes, CampaignNode{VID: vid, ThingID: records[vid].ThingID, FromVersion: records[vid].Firmware, State: statePosting})
+		}
+		if err := storeCampaign(appName, cp); err != nil {
+			a.Fatal("failed to store campaign: ", err)
+		}
+		for i, vid := range vids {
+			n := &cp.Nodes[i]
+			resp, err := post(gCtx, app, user, n.ThingID, command)
+			if err != nil {
+				n.State, n.Error = statePostFailed, err.Error()
+				fmt.Printf("  failed %s: %v\n", vid, err)
+			} else {
+				n.CommandID, n.State = resp.CommandID, "SENDING"
+				fmt.Printf("  posted %s: %s\n", vid, resp.CommandID)
+				stepCompleted("post firmware update " + vid)
+			}
+			if err := storeCampaign(appName, cp); err != nil {
+				a.Fatal("failed to store campaign: ", err)
+			}
+		}
+		updated, failed := cp.counts()
+		fmt.Printf("campaign %s: %d end-node(s), %d updated, %d failed. check progress by firmware campaign status %s\n",
+			name, len(cp.Nodes), updated, failed, name)
+		a.Done()
+	},
+}
+
+// campaignNodes selects the end-nodes below target of thingType from records.
+// Without thingType, the selected end-nodes must be of a single thing type,
+// which is returned. End-nodes of unknown thing type or firmware version are
+// returned as unknown unless includeUnknown is true.
+func campaignNodes(records map[string]NodeRecord, thingType string, target string, includeUnknown bool) (vids []string, unknown []string, selected string, err error) {
+	types := map[string]bool{}
+	for vid, r := range records {
+		if thingType != "" && r.ThingType != thingType {
+			continue
+		}
+		if r.Firmware != "" && compareVersions(r.Firmware, target) >= 0 {
+			continue
+		}
+		if (r.ThingType == "" || r.Firmware == "") && !includeUnknown {
+			unknown = append(unknown, vid)
+			continue
+		}
+		if r.ThingType != "" {
+			types[r.ThingType] = true
+		}
+		vids = append(vids, vid)
+	}
+	sort.Strings(vids)
+	sort.Strings(unknown)
+	if thingType != "" {
+		return vids, unknown, thingType, nil
+	}
+	var names []string
+	for t := range types {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	switch len(names) {
+	case 0:
+		return vids, unknown, "", nil
+	case 1:
+		return vids, unknown, names[0], nil
+	}
+	return nil, unknown, "", fmt.Errorf("the end-nodes are of several thing types: %s. specify --thing-type", strings.Join(names, ", "))
+}
+
+// campaignCommand returns the command posted to the end-nodes of thingType
+// completed by its profile, and whether it is a trait command.
+func campaignCommand(thingType string, command []byte) (traits bool, completed []byte, err error) {
+	profile, ok := gConfig.ThingTypes[thingType]
+	if !ok {
+		return false, command, nil
+	}
+	if profile.Traits {
+		return true, command, nil
+	}
+	completed, err = profile.completeCommand(command)
+	return false, completed, err
+}
+
+var campaignStatus = cli.Command{
+	Name:      "status",
+	Usage:     "status <campaign name> [--no-refresh] --app-name <app name>",
+	UsageText: "Track the commands and the firmware versions of the end-nodes in the campaign and report completion.",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "app-name",
+		},
+		userFlag,
+		cli.BoolFlag{
+			Name:  "no-refresh",
+			Usage: "Report the states stored in the DB without asking Kii Cloud",
+		},
+	},
+	Action: func(c *cli.Context) {
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		name := c.Args().First()
+		cp, err := storedCampaign(appName, name)
+		if err != nil {
+			stdLog.Fatalln("failed to read campaign from db: ", err)
+		}
+		if cp == nil {
+			stdLog.Fatalf("campaign %q is not found\n", name)
+		}
+		if !c.Bool("no-refresh") {
+			user := mustUser(c, appName)
+			trackCampaign(appName, app, user, cp)
+			if err := storeCampaign(appName, *cp); err != nil {
+				stdLog.Fatalln("failed to store campaign: ", err)
+			}
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "END-NODE\tFROM\tCOMMAND\tSTATE\tERROR")
+		for _, n := range cp.Nodes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", n.VID, orUnknown(n.FromVersion), n.CommandID, n.State, n.Error)
+		}
+		w.Flush()
+		updated, failed := cp.counts()
+		rest := len(cp.Nodes) - updated - failed
+		fmt.Printf("%d/%d updated to %s, %d failed, %d in progress.\n", updated, len(cp.Nodes), cp.TargetVersion, failed, rest)
+		if rest == 0 {
+			fmt.Printf("campaign %s is completed.\n", cp.Name)
+		}
+	},
+}
+
+// trackCampaign updates the states of the unfinished end-nodes in cp from
+// Kii Cloud. The firmware version reaching the target is recorded.
+func trackCampaign(appName string, app App, user User, cp *Campaign) {
+	for i := range cp.Nodes {
+		n := &cp.Nodes[i]
+		if n.finished() {
+			continue
+		}
+		version, err := _getFirmwareVersion(gCtx, app, user, n.ThingID)
+		if err != nil {
+			stdLog.Warnf("failed to get firmware version of %s: %v\n", n.VID, err)
+			continue
+		}
+		if version != "" && compareVersions(version, cp.TargetVersion) >= 0 {
+			n.State, n.Error = stateUpdated, ""
+			err = updateNodeRecord(appName, n.VID, func(r *NodeRecord) { r.Firmware = version })
+			if err != nil {
+				stdLog.Warnf("failed to store firmware version of %s: %v\n", n.VID, err)
+			}
+			continue
+		}
+		if n.CommandID == "" {
+			// start was interrupted before the command was posted, or
+			// before its command id was stored. The command may not be
+			// posted, so it isn't tracked any more.
+			n.State, n.Error = statePostFailed, "start was interrupted before the command was posted. start another campaign for the end-node"
+			continue
+		}
+		state, err := _getCommandState(gCtx, app, user, n.ThingID, n.CommandID)
+		if err != nil {
+			stdLog.Warnf("failed to get command of %s: %v\n", n.VID, err)
+			continue
+		}
+		n.State = state
+	}
+}
+
+func (cp Campaign) counts() (updated int, failed int) {
+	for _, n := range cp.Nodes {
+		switch {
+		case n.State == stateUpdated:
+			updated++
+		case n.finished():
+			failed++
+		}
+	}
+	return
+}
+
+// refreshFirmware fetches the thing types and the firmware versions of the
+// end-nodes from Kii Cloud and stores them.
+func refreshFirmware(appName string, app App, user User) {
+	nodes, err := storedNodes(appName)
+	if err != nil {
+		stdLog.Fatalln("failed to read end-nodes from db: ", err)
+	}
+	for vid, n := range nodes {
+		thingType, version, err := _getThing(gCtx, app, user, n.ID)
+		if err != nil {
+			stdLog.Warnf("failed to get %s from Kii Cloud: %v\n", vid, err)
+			continue
+		}
+		err = updateNodeRecord(appName, vid, func(r *NodeRecord) {
+			r.ThingType, r.Firmware = thingType, version
+		})
+		if err != nil {
+			stdLog.Fatalln("failed to store firmware version: ", err)
+		}
+	}
+}
+
+// selectNodes returns the end-nodes selected by --node-vid, --thing-type or
+// --all.
+func selectNodes(c *cli.Context, appName string) []Node {
+	records, err := storedNodeRecords(appName)
+	if err != nil {
+		stdLog.Fatalln("failed to read end-nodes from db: ", err)
+	}
+	var selected []Node
+	switch {
+	case len(c.StringSlice("node-vid")) > 0:
+		for _, vid := range c.StringSlice("node-vid") {
+			r, ok := records[vid]
+			if !ok {
+				stdLog.Fatalf("end-node %s is not found. execute onboard-node\n", vid)
+			}
+			selected = append(selected, r.Node())
+		}
+	case c.String("thing-type") != "":
+		for _, r := range records {
+			if r.ThingType == c.String("thing-type") {
+				selected = append(selected, r.Node())
+			}
+		}
+	case c.Bool("all"):
+		for _, r := range records {
+			selected = append(selected, r.Node())
+		}
+	default:
+		stdLog.Fatalln("specify --node-vid, --thing-type or --all")
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].VID < selected[j].VID })
+	return selected
+}
+
+func storedCampaigns(appName string) ([]Campaign, error) {
+	var campaigns []Campaign
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("campaigns:" + appName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var cp Campaign
+			if err := json.Unmarshal(v, &cp); err != nil {
+				return err
+			}
+			campaigns = append(campaigns, cp)
+			return nil
+		})
+	})
+	return campaigns, err
+}
+
+// storedCampaign returns the campaign named name, nil when it is not found.
+func storedCampaign(appName string, name string) (*Campaign, error) {
+	var cp *Campaign
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("campaigns:" + appName))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		cp = &Campaign{}
+		return json.Unmarshal(v, cp)
+	})
+	return cp, err
+}
+
+func storeCampaign(appName string, cp Campaign) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("campaigns:" + appName))
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(cp)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(cp.Name), v)
+	})
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
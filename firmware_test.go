@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCampaignNodes(t *testing.T) {
+	records := map[string]NodeRecord{
+		"S1": {VID: "S1", ThingType: "sensor", Firmware: "1.0"},
+		"S2": {VID: "S2", ThingType: "sensor", Firmware: "2.0"},
+		"L1": {VID: "L1", ThingType: "lamp", Firmware: "1.0"},
+		"U1": {VID: "U1", Firmware: "1.0"},
+		"U2": {VID: "U2", ThingType: "sensor"},
+	}
+	tests := []struct {
+		name           string
+		thingType      string
+		includeUnknown bool
+		vids, unknown  []string
+		selected       string
+		fails          bool
+	}{
+		{name: "given thing type", thingType: "sensor", vids: []string{"S1"}, unknown: []string{"U2"}, selected: "sensor"},
+		{name: "given thing type with unknown", thingType: "sensor", includeUnknown: true, vids: []string{"S1", "U2"}, selected: "sensor"},
+		{name: "mixed thing types", unknown: []string{"U1", "U2"}, fails: true},
+	}
+	for _, tt := range tests {
+		vids, unknown, selected, err := campaignNodes(records, tt.thingType, "2.0", tt.includeUnknown)
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: err = %v, want fails %v", tt.name, err, tt.fails)
+		}
+		if !reflect.DeepEqual(vids, tt.vids) || !reflect.DeepEqual(unknown, tt.unknown) || selected != tt.selected {
+			t.Errorf("%s: campaignNodes() = %v, %v, %q, want %v, %v, %q", tt.name, vids, unknown, selected, tt.vids, tt.unknown, tt.selected)
+		}
+	}
+}
+
+// TestCampaignNodesSingleThingType checks the thing type of the end-nodes is
+// selected without --thing-type, so that its profile shapes the command.
+func TestCampaignNodesSingleThingType(t *testing.T) {
+	defer func(c Config) { gConfig = c }(gConfig)
+	gConfig = Config{ThingTypes: map[string]ThingTypeProfile{
+		"sensor": {Traits: true},
+		"lamp":   {CommandSchema: CommandSchema{Name: "LampSchema", Version: 2}},
+	}}
+	tests := []struct {
+		records  map[string]NodeRecord
+		selected string
+		traits   bool
+		command  string
+	}{
+		{
+			records:  map[string]NodeRecord{"S1": {VID: "S1", ThingType: "sensor", Firmware: "1.0"}},
+			selected: "sensor",
+			traits:   true,
+			command:  `{"actions":[]}`,
+		},
+		{
+			records:  map[string]NodeRecord{"L1": {VID: "L1", ThingType: "lamp", Firmware: "1.0"}},
+			selected: "lamp",
+			command:  `{"actions":[],"schema":"LampSchema","schemaVersion":2}`,
+		},
+	}
+	for _, tt := range tests {
+		_, _, selected, err := campaignNodes(tt.records, "", "2.0", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selected != tt.selected {
+			t.Errorf("selected = %q, want %q", selected, tt.selected)
+		}
+		traits, command, err := campaignCommand(selected, []byte(`{"actions":[]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if traits != tt.traits || string(command) != tt.command {
+			t.Errorf("campaignCommand(%s) = %v, %s, want %v, %s", selected, traits, command, tt.traits, tt.command)
+		}
+	}
+}
@@ -1,26 +1,41 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/koron/go-dproxy"
 )
 
-func localAuth(addr GatewayAddress, app App, username string, password string) (string, error) {
+// newRequest returns a request canceled with ctx.
+func newRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+func localAuth(ctx context.Context, addr GatewayAddress, app App, username string, password string) (token string, err error) {
+	defer observe(targetGateway, "token", time.Now(), &err)
 	if username == "" || password == "" {
 		return "", errors.New("username or password is not given")
 	}
 	url := fmt.Sprintf("http://%s:%d/%s/token", addr.Host, addr.Port, app.Site)
 	payload := fmt.Sprintf("{\"username\":\"%s\",\"password\":\"%s\"}", username, password)
 	basicAuth := base64.StdEncoding.EncodeToString([]byte(app.ID + ":" + app.Key))
-	req, _ := http.NewRequest("POST", url, strings.NewReader(payload))
+	req, err := newRequest(ctx, "POST", url, strings.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
 
 	req.Header.Add("authorization", "Basic "+basicAuth)
 
@@ -44,16 +59,20 @@ func localAuth(addr GatewayAddress, app App, username string, password string) (
 	if err != nil {
 		return "", err
 	}
+	if exp, ok := jwtExpiry(t); ok {
+		tokenExpiry.WithLabelValues(appLabel(app), "gateway").Set(float64(exp.Unix()))
+	}
 	return t, nil
 }
 
-func _replaceNode(addr GatewayAddress, app App, node Node, token string) error {
+func _replaceNode(ctx context.Context, addr GatewayAddress, app App, node Node, token string) (err error) {
+	defer observe(targetGateway, "replace-end-node", time.Now(), &err)
 	url := fmt.Sprintf("http://%s:%d/%s/apps/%s/gateway/end-nodes/%s",
 		addr.Host, addr.Port, app.Site, app.ID, node.ID)
 
 	payload := fmt.Sprintf("{\"vendorThingID\":\"%s\"}", node.VID)
 
-	req, err := http.NewRequest("PUT", url, strings.NewReader(payload))
+	req, err := newRequest(ctx, "PUT", url, strings.NewReader(payload))
 	if err != nil {
 		return err
 	}
@@ -64,15 +83,17 @@ func _replaceNode(addr GatewayAddress, app App, node Node, token string) error {
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 	if res.StatusCode < 200 || 400 <= res.StatusCode {
 		return errors.New(fmt.Sprintf("failed to replace end-node. (%d)", res.StatusCode))
 	}
 	return nil
 }
 
-func _restore(addr GatewayAddress, app App, token string) error {
+func _restore(ctx context.Context, addr GatewayAddress, app App, token string) (err error) {
+	defer observe(targetGateway, "restore", time.Now(), &err)
 	url := fmt.Sprintf("http://%s:%d/gateway-app/gateway/restore", addr.Host, addr.Port)
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := newRequest(ctx, "POST", url, nil)
 	if err != nil {
 		return err
 	}
@@ -81,19 +102,21 @@ func _restore(addr GatewayAddress, app App, token string) error {
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 	if res.StatusCode < 200 || 400 <= res.StatusCode {
 		return errors.New(fmt.Sprintf("failed to resotore. (%d)", res.StatusCode))
 	}
 	return nil
 }
 
-func _mapNode(addr GatewayAddress, app App, node Node, token string) error {
+func _mapNode(ctx context.Context, addr GatewayAddress, app App, node Node, token string) (err error) {
+	defer observe(targetGateway, "map-end-node", time.Now(), &err)
 	url := fmt.Sprintf("http://%s:%d/%s/apps/%s/gateway/end-nodes/VENDOR_THING_ID:%s",
 		addr.Host, addr.Port, app.Site, app.ID, node.VID)
 
 	payload := fmt.Sprintf("{\"thingID\":\"%s\"}", node.ID)
 
-	req, err := http.NewRequest("PUT", url, strings.NewReader(payload))
+	req, err := newRequest(ctx, "PUT", url, strings.NewReader(payload))
 	if err != nil {
 		return err
 	}
@@ -104,33 +127,53 @@ func _mapNode(addr GatewayAddress, app App, node Node, token string) error {
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 	if res.StatusCode < 200 || 400 <= res.StatusCode {
 		return errors.New(fmt.Sprintf("failed to map end-node. (%d)", res.StatusCode))
 	}
 	return nil
 }
 
-func _listPendingNodes(addr GatewayAddress, app App, token string) ([]string, error) {
+func _listPendingNodes(ctx context.Context, addr GatewayAddress, app App, token string) (vids []string, err error) {
+	defer observe(targetGateway, "list-pending-end-nodes", time.Now(), &err)
 	url := fmt.Sprintf("http://%s:%d/%s/apps/%s/gateway/end-nodes/pending",
 		addr.Host, addr.Port, app.Site, app.ID)
-	req, _ := http.NewRequest("GET", url, nil)
+	req, err := newRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Add("authorization", "Bearer "+token)
-	res, _ := http.DefaultClient.Do(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
 
 	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode < 200 || 400 <= res.StatusCode {
+		return nil, errors.New(fmt.Sprintf("failed to list pending end-nodes. (%d)", res.StatusCode))
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
 	var v interface{}
-	err := json.Unmarshal(body, &v)
+	err = json.Unmarshal(body, &v)
 	if err != nil {
-		fmt.Printf("parse body error:%v", err)
 		return nil, err
 	}
-	return dproxy.New(v).Q("vendorThingID").StringArray()
+	vids, err = dproxy.New(v).Q("vendorThingID").StringArray()
+	if err != nil {
+		return nil, err
+	}
+	pendingNodes.WithLabelValues(gatewayLabel(addr)).Set(float64(len(vids)))
+	return vids, nil
 }
 
-func _onboardGateway(addr GatewayAddress, app App, token string) (string, error) {
+func _onboardGateway(ctx context.Context, addr GatewayAddress, app App, token string) (id string, err error) {
+	defer observe(targetGateway, "onboard-gateway", time.Now(), &err)
+	defer func() { onboardingsTotal.WithLabelValues("gateway", outcome(err)).Inc() }()
 	url := fmt.Sprintf("http://%s:%d/%s/apps/%s/gateway/onboarding", addr.Host, addr.Port, app.Site, app.ID)
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := newRequest(ctx, "POST", url, nil)
 	if err != nil {
 		return "", err
 	}
@@ -146,7 +189,7 @@ func _onboardGateway(addr GatewayAddress, app App, token string) (string, error)
 	if err != nil {
 		return "", err
 	}
-	log.Printf("resp body:%s\n", string(body))
+	stdLog.Debugf("resp body:%s\n", string(body))
 	var v interface{}
 	err = json.Unmarshal(body, &v)
 	if err != nil {
@@ -159,12 +202,14 @@ func _onboardGateway(addr GatewayAddress, app App, token string) (string, error)
 	return t, nil
 }
 
-func _onboardMasterGateway(addr GatewayAddress, app App, token string) (string, error) {
+func _onboardMasterGateway(ctx context.Context, addr GatewayAddress, app App, token string) (id string, err error) {
+	defer observe(targetGateway, "onboard-master-gateway", time.Now(), &err)
+	defer func() { onboardingsTotal.WithLabelValues("master-gateway", outcome(err)).Inc() }()
 	if token == "" {
 		return "", errors.New("token is not given")
 	}
 	url := fmt.Sprintf("http://%s:%d/gateway-app/gateway/onboarding", addr.Host, addr.Port)
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := newRequest(ctx, "POST", url, nil)
 	if err != nil {
 		return "", err
 	}
@@ -180,7 +225,7 @@ func _onboardMasterGateway(addr GatewayAddress, app App, token string) (string,
 	if err != nil {
 		return "", err
 	}
-	log.Printf("resp body:%s\n", string(body))
+	stdLog.Debugf("resp body:%s\n", string(body))
 	var v interface{}
 	err = json.Unmarshal(body, &v)
 	if err != nil {
@@ -192,3 +237,48 @@ func _onboardMasterGateway(addr GatewayAddress, app App, token string) (string,
 	}
 	return t, nil
 }
+
+func _listOnboardedNodes(ctx context.Context, addr GatewayAddress, app App, token string) (nodes []Node, err error) {
+	defer observe(targetGateway, "list-onboarded-end-nodes", time.Now(), &err)
+	url := fmt.Sprintf("http://%s:%d/%s/apps/%s/gateway/end-nodes/onboarded",
+		addr.Host, addr.Port, app.Site, app.ID)
+	req, err := newRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode < 200 || 400 <= res.StatusCode {
+		return nil, errors.New(fmt.Sprintf("failed to list onboarded end-nodes. (%d)", res.StatusCode))
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(body, &v)
+	if err != nil {
+		return nil, err
+	}
+	vids, err := dproxy.New(v).Q("vendorThingID").StringArray()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := dproxy.New(v).Q("thingID").StringArray()
+	if err != nil {
+		return nil, err
+	}
+	if len(vids) != len(ids) {
+		return nil, errors.New("unexpected response of onboarded end-nodes: " + string(body))
+	}
+	nodes = make([]Node, len(vids))
+	for i := range vids {
+		nodes[i] = Node{ID: ids[i], VID: vids[i]}
+	}
+	return nodes, nil
+}
@@ -1,12 +1,33 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
 
 	kii "github.com/KiiPlatform/kii_go"
 	"github.com/sirupsen/logrus"
 )
 
+// LogConfig configures the logs. --log-level, --log-format and --log-file
+// override it.
+type LogConfig struct {
+	// Level is one of debug, info, warn and error. Default is info.
+	Level string `yaml:"level"`
+	// Format is text or json. Default is text.
+	Format string `yaml:"format"`
+	// File is written in addition to stderr when given.
+	File string `yaml:"file"`
+	// MaxSize is the size of File in MB to rotate it. Default is 10.
+	MaxSize int `yaml:"max-size"`
+	// MaxBackups is the number of rotated files kept. Default is 3.
+	MaxBackups int `yaml:"max-backups"`
+}
+
 // Logger implementation of kii.KiiLogger
 type Logger struct {
 }
@@ -15,49 +36,174 @@ var (
 	// force to verify whether Logger implement all the method of KiiLogger interface.
 	_      kii.KiiLogger = (*Logger)(nil)
 	stdLog *logrus.Logger
+	// kiiLog is stdLog for the lines of kii_go.
+	kiiLog *logrus.Entry
+	// correlationID is put on every line to tell the lines of an invocation.
+	correlationID = newCorrelationID()
 )
 
 func init() {
 	stdLog = logrus.New()
-	stdLog.Out = os.Stdout
+	stdLog.Out = os.Stderr
+	stdLog.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	stdLog.Hooks.Add(correlationHook{})
+	kiiLog = stdLog.WithField("component", "kii_go")
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "-"
+	}
+	return hex.EncodeToString(b)
+}
+
+// correlationHook puts correlationID on every line and trims the newline
+// at the end of messages given to Printf.
+type correlationHook struct{}
+
+func (h correlationHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h correlationHook) Fire(e *logrus.Entry) error {
+	e.Data["cid"] = correlationID
+	e.Message = strings.TrimSuffix(e.Message, "\n")
+	return nil
+}
+
+// setupLogging configures stdLog. Empty arguments are taken from conf.
+func setupLogging(conf LogConfig, level string, format string, file string) error {
+	if level == "" {
+		level = conf.Level
+	}
+	if level != "" {
+		l, err := logrus.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		stdLog.SetLevel(l)
+	}
+	if format == "" {
+		format = conf.Format
+	}
+	switch format {
+	case "", "text":
+	case "json":
+		stdLog.Formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %s. available formats: text, json", format)
+	}
+	if file == "" {
+		file = conf.File
+	}
+	if file != "" {
+		maxSize, maxBackups := conf.MaxSize, conf.MaxBackups
+		if maxSize <= 0 {
+			maxSize = 10
+		}
+		if maxBackups <= 0 {
+			maxBackups = 3
+		}
+		f, err := openRotatingFile(file, int64(maxSize)*1024*1024, maxBackups)
+		if err != nil {
+			return err
+		}
+		stdLog.Out = io.MultiWriter(os.Stderr, f)
+	}
+	return nil
+}
+
+// rotatingFile is a log file renamed to <path>.1 when it exceeds maxSize.
+// Older ones are shifted up to <path>.<maxBackups>.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
 }
 
 // Debug writes debug message to log.
 func (l *Logger) Debug(message string) {
-	stdLog.Debug(message)
+	kiiLog.Debug(message)
 }
 
 // Debugf formats debug message according to a format specifier and write it to log.
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	stdLog.Debug(format, v)
+	kiiLog.Debugf(format, v...)
 }
 
 // Info writes info message to log.
 func (l *Logger) Info(message string) {
-	stdLog.Info(message)
+	kiiLog.Info(message)
 }
 
 // Infof formats info message according to a format specifier and write it to log.
 func (l *Logger) Infof(format string, v ...interface{}) {
-	stdLog.Info(format, v)
+	kiiLog.Infof(format, v...)
 }
 
 // Warn writes warn message to log.
 func (l *Logger) Warn(message string) {
-	stdLog.Warn(message)
+	kiiLog.Warn(message)
 }
 
 // Warnf formats warn message according to a format specifier and write it to log.
 func (l *Logger) Warnf(format string, v ...interface{}) {
-	stdLog.Warnf(format, v)
+	kiiLog.Warnf(format, v...)
 }
 
 // Error writes error message to log.
 func (l *Logger) Error(message string) {
-	stdLog.Error(message)
+	kiiLog.Error(message)
 }
 
 // Errorf formats error message according to a format specifier and write it to log.
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	stdLog.Errorf(format, v)
+	kiiLog.Errorf(format, v...)
 }
@@ -1,20 +1,31 @@
 package main
 
 import (
-	"io/ioutil"
-	"log"
+	"net/http"
 	"os"
 
 	kii "github.com/KiiPlatform/kii_go"
-	"github.com/boltdb/bolt"
 	"github.com/codegangsta/cli"
-	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
 	Apps           map[string]App `yaml:"apps"`
 	GatewayAddress GatewayAddress `yaml:"gateway-address"`
 	DB             string         `yaml:"db"`
+
+	// CredentialHelper is the command asked for passwords not given by flags.
+	CredentialHelper string `yaml:"credential-helper"`
+	// SecretKeyFile is the key encrypting end-node passwords stored in the
+	// DB. It defaults to the DB path followed by .key.
+	SecretKeyFile string `yaml:"secret-key-file"`
+	// Gateways are named gateways selected by --gateway or use-gateway.
+	Gateways map[string]GatewayAddress `yaml:"gateways"`
+	// HTTP configures timeout and retry of requests to Gateway Agent and Kii Cloud.
+	HTTP HTTPConfig `yaml:"http"`
+	// Log configures the logs of the CLI and kii_go.
+	Log LogConfig `yaml:"log"`
+	// ThingTypes are the profiles of end-nodes keyed by thing type.
+	ThingTypes map[string]ThingTypeProfile `yaml:"thing-types"`
 }
 
 type GatewayAddress struct {
@@ -29,8 +40,9 @@ type App struct {
 }
 
 type User struct {
-	ID    string `json:"id"`
-	Token string `json:"token"`
+	ID       string `json:"id"`
+	Token    string `json:"token"`
+	Username string `json:"username,omitempty"`
 }
 
 type Node struct {
@@ -40,66 +52,157 @@ type Node struct {
 
 // Global variables. :(
 var gConfig Config
-var db *bolt.DB
 
-func main() {
-	var configFile string
-	if os.Getenv("GWM_CONFIG_PATH") != "" {
-		configFile = os.Getenv("GWM_CONFIG_PATH")
-	} else {
-		configFile = "./config.yml"
-	}
-	kii.Logger = &Logger{}
-	b, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		log.Fatalln("can't read "+configFile+" file.", err)
-	}
-	err = yaml.Unmarshal(b, &gConfig)
-	if err != nil {
-		log.Fatalln("can't unmarshal "+configFile, err)
-	}
+// gConfigRaw is the merged config files before resolving references.
+var gConfigRaw map[interface{}]interface{}
+var gConfigFiles []string
 
-	dbFile := gConfig.DB
-	if dbFile == "" {
-		dbFile = "manager.db"
-	}
+// gConfigErr is the error loading the config. Commands other than config
+// fail with it.
+var gConfigErr error
+var db *DB
 
-	db, err = bolt.Open(dbFile, 0600, nil)
-	if err != nil {
-		log.Fatalln("can't open "+dbFile, err)
-	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("tokens"))
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists([]byte("gateway-ids"))
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists([]byte("users"))
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-	if err != nil {
-		log.Fatalln("can't create bucket: ", err)
-	}
+func main() {
+	kii.Logger = &Logger{}
+	gConfigFiles = configFiles()
+	gConfig, gConfigRaw, gConfigErr = loadConfig(gConfigFiles)
 
 	app := cli.NewApp()
 	app.Name = "gw-manager"
 	app.Version = "1.0.0"
 	app.Usage = "Sample app shows how to manage Gateway. Specify the path of config file with env variable GWM_CONFIG_PATH" +
-		"when config file located in different folder with binary file"
+		"when config file located in different folder with binary file. Several files separated by ':' are layered in order"
 	app.Author = "Kii Corporation"
 	app.Email = "support@kii.com"
 	app.Commands = Commands
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "app-name",
-			Usage: "Specifiy app name configured in config file",
+			Name:   "app-name",
+			Usage:  "Specifiy app name configured in config file. Used when the command is not given --app-name",
+			EnvVar: "GWM_APP_NAME",
+		},
+		cli.StringFlag{
+			Name:   "gateway",
+			Usage:  "Specifiy gateway name configured in gateways of config file",
+			EnvVar: "GWM_GATEWAY",
+		},
+		cli.StringFlag{
+			Name:   "user",
+			Usage:  "Specifiy the user name stored by user-login. Used when the command is not given --user",
+			EnvVar: "GWM_USER",
+		},
+		cli.StringFlag{
+			Name:   "credential-helper",
+			Usage:  "Command asked for passwords not given by flags, in the manner of git-credential",
+			EnvVar: "GWM_CREDENTIAL_HELPER",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print HTTP requests to Gateway Agent and Kii Cloud and writes to the DB instead of executing them",
+		},
+		cli.StringFlag{
+			Name:  "trace-file",
+			Usage: "Capture HTTP requests and responses to Gateway Agent and Kii Cloud into the HAR file. Passwords and tokens are redacted",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Usage:  "Log level. debug, info, warn or error",
+			EnvVar: "GWM_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "Log format. text or json",
+			EnvVar: "GWM_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-file",
+			Usage:  "Write logs also to the file. It is rotated by log.max-size in the config file",
+			EnvVar: "GWM_LOG_FILE",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Cancel the command after the duration, e.g. 5m. The steps completed are printed",
+		},
+		cli.StringFlag{
+			Name:  "record",
+			Usage: "Record HTTP interactions with Gateway Agent and Kii Cloud into the directory",
+		},
+		cli.StringFlag{
+			Name:  "replay",
+			Usage: "Serve HTTP interactions recorded in the directory instead of sending requests",
 		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Usage:  "Serve Prometheus metrics on http://<addr>/metrics while the command runs, e.g. :9100",
+			EnvVar: "GWM_METRICS_ADDR",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if c.Args().First() == completeCommandName || inShell {
+			// Keep the completion quiet and the DB unlocked. Commands in
+			// the shell share the set up done when it started.
+			return nil
+		}
+		if c.Args().First() == configCommand.Name {
+			// config inspects and validates the config without the DB,
+			// which may be the problem.
+			return nil
+		}
+		if gConfigErr != nil {
+			stdLog.Fatalf("can't load config: %v\nexecute config validate to locate the problems.\n", gConfigErr)
+		}
+		err := setupLogging(gConfig.Log, c.GlobalString("log-level"), c.GlobalString("log-format"), c.GlobalString("log-file"))
+		if err != nil {
+			stdLog.Fatalln("can't set up logging: ", err)
+		}
+		if c.Args().First() != shellCommand.Name {
+			startCancellation(c.GlobalDuration("timeout"))
+		}
+		if addr := c.GlobalString("metrics-addr"); addr != "" {
+			startMetricsServer(addr)
+		}
+		dryRun := c.GlobalBool("dry-run")
+		record, replay := c.GlobalString("record"), c.GlobalString("replay")
+		if record != "" && (replay != "" || dryRun) {
+			stdLog.Fatalln("--record can't be used with --replay or --dry-run")
+		}
+		if replay != "" && dryRun {
+			stdLog.Fatalln("--replay can't be used with --dry-run")
+		}
+		if replay != "" {
+			t, err := newReplayTransport(replay)
+			if err != nil {
+				stdLog.Fatalln("can't replay: ", err)
+			}
+			http.DefaultTransport = t
+		}
+		if dryRun {
+			http.DefaultTransport = dryRunTransport{}
+		}
+		if record != "" {
+			t, err := newRecordTransport(http.DefaultTransport, record)
+			if err != nil {
+				stdLog.Fatalln("can't record: ", err)
+			}
+			http.DefaultTransport = t
+		}
+		if path := c.GlobalString("trace-file"); path != "" {
+			http.DefaultTransport = newHARTransport(http.DefaultTransport, path, app.Version)
+		}
+		// Outermost so that every attempt is traced and recorded.
+		http.DefaultTransport = retryTransport{next: http.DefaultTransport, config: gConfig.HTTP}
+		dbFile := dbPath(gConfig)
+		db, err = openDB(dbFile, dryRun)
+		if err != nil {
+			stdLog.Fatalln("can't open "+dbFile, err)
+		}
+		return nil
+	}
+	app.After = func(c *cli.Context) error {
+		if db != nil && !inShell {
+			return db.Close()
+		}
+		return nil
 	}
 
 	app.Run(os.Args)
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics of the adapters served on /metrics by --metrics-addr.
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gwm_requests_total",
+		Help: "Requests to Gateway Agent endpoints and Kii Cloud operations.",
+	}, []string{"target", "operation", "outcome"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gwm_request_duration_seconds",
+		Help:    "Latency of requests to Gateway Agent endpoints and Kii Cloud operations including retries.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"target", "operation"})
+	onboardingsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gwm_onboardings_total",
+		Help: "Onboardings of gateways and end-nodes.",
+	}, []string{"kind", "outcome"})
+	commandsPosted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gwm_commands_posted_total",
+		Help: "Commands posted to end-nodes per app.",
+	}, []string{"app"})
+	pendingNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gwm_pending_nodes",
+		Help: "End-nodes pending on the gateway when it was last listed.",
+	}, []string{"gateway"})
+	tokenExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gwm_token_expiry_timestamp_seconds",
+		Help: "Unix time the token obtained expires at.",
+	}, []string{"app", "kind"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, onboardingsTotal,
+		commandsPosted, pendingNodes, tokenExpiry)
+}
+
+// startMetricsServer serves /metrics on addr while the command runs.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			stdLog.Warnln("can't serve metrics:", err)
+		}
+	}()
+	stdLog.Infof("serving metrics on http://%s/metrics\n", addr)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// observe records a request of the adapter. Call it deferred with the
+// named error of the adapter:
+//
+//	defer observe(targetGateway, "map-node", time.Now(), &err)
+func observe(target string, operation string, start time.Time, err *error) {
+	requestsTotal.WithLabelValues(target, operation, outcome(*err)).Inc()
+	requestDuration.WithLabelValues(target, operation).Observe(time.Since(start).Seconds())
+}
+
+// appLabel returns the name of app in the config, or its ID when it is not
+// configured.
+func appLabel(app App) string {
+	for name, a := range gConfig.Apps {
+		if a.ID == app.ID {
+			return name
+		}
+	}
+	return app.ID
+}
+
+func gatewayLabel(addr GatewayAddress) string {
+	return fmt.Sprintf("%s:%d", addr.Host, addr.Port)
+}
+
+// jwtExpiry returns exp of token when it is a JWT.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// NodeRecord is an end-node stored in the nodes:<app> bucket keyed by vendor
+// thing id. The node-ids:<app> bucket maps its thing id to the vendor thing
+// id.
+type NodeRecord struct {
+	ThingID   string `json:"thingID"`
+	VID       string `json:"vid"`
+	ThingType string `json:"thingType,omitempty"`
+	Firmware  string `json:"firmwareVersion,omitempty"`
+	// Gateway is the thing id of the gateway the end-node belongs to.
+	Gateway string `json:"gateway,omitempty"`
+	// Owner is the owner given at onboarding, e.g. user:<user id>.
+	Owner string `json:"owner,omitempty"`
+	// OnboardedAt is nil, or zero when written by an earlier build, for the
+	// end-nodes onboarded by older versions.
+	OnboardedAt *time.Time `json:"onboardedAt,omitempty"`
+	// ReplacedFrom is the vendor thing id before the last replace-node.
+	ReplacedFrom string            `json:"replacedFrom,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+func (r NodeRecord) Node() Node {
+	return Node{ID: r.ThingID, VID: r.VID}
+}
+
+// parseLabels parses key=value pairs.
+func parseLabels(pairs []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("label %q is not key=value", p)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+var nodeCommand = cli.Command{
+	Name:      "node",
+	Usage:     "node show <vendor thing id | thing id> | node label <vendor thing id> key=value... [--remove key]",
+	UsageText: "Inspect and label end-nodes stored in the DB.",
+	Subcommands: []cli.Command{
+		{
+			Name:      "show",
+			Usage:     "show <vendor thing id | thing id> [--json] --app-name <app name>",
+			UsageText: "Show the record of the end-node.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "app-name",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the record in JSON",
+				},
+			},
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				mustApp(appName)
+				r := mustNodeRecord(appName, c.Args().First())
+				if c.Bool("json") {
+					b, _ := json.MarshalIndent(r, "", "  ")
+					fmt.Println(string(b))
+					return
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintf(w, "vendor thing id:\t%s\n", r.VID)
+				fmt.Fprintf(w, "thing id:\t%s\n", r.ThingID)
+				fmt.Fprintf(w, "thing type:\t%s\n", orUnknown(r.ThingType))
+				fmt.Fprintf(w, "firmware version:\t%s\n", orUnknown(r.Firmware))
+				fmt.Fprintf(w, "gateway:\t%s\n", orUnknown(r.Gateway))
+				fmt.Fprintf(w, "owner:\t%s\n", orUnknown(r.Owner))
+				onboardedAt := "unknown"
+				if r.OnboardedAt != nil && !r.OnboardedAt.IsZero() {
+					onboardedAt = r.OnboardedAt.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "onboarded at:\t%s\n", onboardedAt)
+				if r.ReplacedFrom != "" {
+					fmt.Fprintf(w, "replaced from:\t%s\n", r.ReplacedFrom)
+				}
+				var keys []string
+				for k := range r.Labels {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				var labels []string
+				for _, k := range keys {
+					labels = append(labels, k+"="+r.Labels[k])
+				}
+				fmt.Fprintf(w, "labels:\t%s\n", strings.Join(labels, ", "))
+				w.Flush()
+			},
+		},
+		{
+			Name:      "label",
+			Usage:     "label <vendor thing id | thing id> key=value... [--remove key] --app-name <app name>",
+			UsageText: "Set or remove labels of the end-node.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "app-name",
+				},
+				cli.StringSliceFlag{
+					Name:  "remove",
+					Usage: "Key of the label to remove. Can be repeated",
+				},
+			},
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				mustApp(appName)
+				r := mustNodeRecord(appName, c.Args().First())
+				labels, err := parseLabels(c.Args().Tail())
+				if err != nil {
+					stdLog.Fatalln(err)
+				}
+				err = updateNodeRecord(appName, r.VID, func(r *NodeRecord) {
+					if r.Labels == nil {
+						r.Labels = map[string]string{}
+					}
+					for k, v := range labels {
+						r.Labels[k] = v
+					}
+					for _, k := range c.StringSlice("remove") {
+						delete(r.Labels, k)
+					}
+				})
+				if err != nil {
+					stdLog.Fatalln("failed to store end-node: ", err)
+				}
+			},
+		},
+	},
+}
+
+// mustNodeRecord returns the record of the end-node given by vendor thing id
+// or thing id. It exits when the end-node is not found.
+func mustNodeRecord(appName string, vidOrID string) *NodeRecord {
+	if vidOrID == "" {
+		stdLog.Fatalln("no end-node is specified")
+	}
+	r, err := storedNodeRecord(appName, vidOrID)
+	if err != nil {
+		stdLog.Fatalln("failed to read end-node from db: ", err)
+	}
+	if r == nil {
+		stdLog.Fatalf("end-node %s is not found. execute onboard-node\n", vidOrID)
+	}
+	return r
+}
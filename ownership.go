@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// ownershipFlags select the thing whose owners are managed: the stored
+// gateway, or the end-node given by --node-vid.
+var ownershipFlags = []cli.Flag{
+	cli.StringFlag{
+		Name: "app-name",
+	},
+	userFlag,
+	cli.StringFlag{
+		Name:  "node-vid",
+		Usage: "Vendor thing id of the end-node. The gateway when not given",
+	},
+}
+
+var ownerCommand = cli.Command{
+	Name:  "owner",
+	Usage: "owner list|add|remove|transfer",
+	UsageText: `Manage the owners of the gateway and the end-nodes on Kii Cloud. Owners are
+	given as user:<user id>, group:<group id> or a login name of a Kii user.
+	The login user must be an owner of the thing.`,
+	Subcommands: []cli.Command{
+		{
+			Name:      "list",
+			Usage:     "list [--node-vid <vid>] --app-name <app name>",
+			UsageText: "List the owners of the gateway or the end-node.",
+			Flags:     ownershipFlags,
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				app := mustApp(appName)
+				user := mustUser(c, appName)
+				thingID, _ := ownershipTarget(c, appName)
+				owners, err := _listOwners(gCtx, app, user, thingID)
+				if err != nil {
+					stdLog.Fatalln("failed to list owners: ", err)
+				}
+				sort.Strings(owners)
+				for _, o := range owners {
+					if o == "user:"+user.ID {
+						o += " (login user)"
+					}
+					fmt.Println(o)
+				}
+			},
+		},
+		{
+			Name:      "add",
+			Usage:     "add <owner> [--node-vid <vid>] --app-name <app name>",
+			UsageText: "Add the user or the group as an owner of the gateway or the end-node.",
+			Flags:     ownershipFlags,
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				app := mustApp(appName)
+				user := mustUser(c, appName)
+				thingID, target := ownershipTarget(c, appName)
+				owner := mustResolveOwner(app, user, c.Args().First())
+				a := startAudit(c, "owner-add")
+				a.Target(target)
+				a.ID("thingID", thingID)
+				if err := _addThingOwner(gCtx, app, user, thingID, owner); err != nil {
+					a.Fatal("failed to add owner: ", err)
+				}
+				a.Done()
+			},
+		},
+		{
+			Name:      "remove",
+			Usage:     "remove <owner> [--node-vid <vid>] --app-name <app name>",
+			UsageText: "Remove the user or the group from the owners of the gateway or the end-node.",
+			Flags:     ownershipFlags,
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				app := mustApp(appName)
+				user := mustUser(c, appName)
+				thingID, target := ownershipTarget(c, appName)
+				owner := mustResolveOwner(app, user, c.Args().First())
+				if owner == "user:"+user.ID {
+					stdLog.Warnln("removing the login user. it can't manage the thing any more")
+				}
+				a := startAudit(c, "owner-remove")
+				a.Target(target)
+				a.ID("thingID", thingID)
+				if err := _removeOwner(gCtx, app, user, thingID, owner); err != nil {
+					a.Fatal("failed to remove owner: ", err)
+				}
+				a.Done()
+			},
+		},
+		{
+			Name:  "transfer",
+			Usage: "transfer <new owner> [--keep-current] [--node-vid <vid> ...] --app-name <app name>",
+			UsageText: `Hand the gateway and its end-nodes over to the new owner, e.g. from the
+	installer to the customer. The new owner is added to every thing first, then
+	the login user is removed from them unless --keep-current is given.
+	End-nodes stored without a gateway are transferred only when given by --node-vid.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "app-name",
+				},
+				userFlag,
+				cli.BoolFlag{
+					Name:  "keep-current",
+					Usage: "Keep the login user as an owner",
+				},
+				cli.StringSliceFlag{
+					Name:  "node-vid",
+					Usage: "Also transfer the end-node stored without a gateway, e.g. by older versions. Repeatable",
+				},
+			},
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				app := mustApp(appName)
+				user := mustUser(c, appName)
+				gatewayID := storedGatewayID(gatewayKey(c, appName))
+				if gatewayID == "" {
+					stdLog.Fatalln("no gateway-id is stored. please execute onboard-gateway.")
+				}
+				owner := mustResolveOwner(app, user, c.Args().First())
+				if owner == "user:"+user.ID {
+					stdLog.Fatalln("the new owner is the login user")
+				}
+				stored, unassigned, err := gatewayNodes(appName, gatewayID)
+				if err != nil {
+					stdLog.Fatalln("failed to read end-nodes from db: ", err)
+				}
+				things := []Node{{ID: gatewayID, VID: "gateway"}}
+				var nodes []Node
+				for _, n := range stored {
+					nodes = append(nodes, n)
+				}
+				for _, vid := range c.StringSlice("node-vid") {
+					n, ok := unassigned[vid]
+					if !ok {
+						stdLog.Fatalf("%s is not an end-node stored without a gateway\n", vid)
+					}
+					nodes = append(nodes, n)
+					delete(unassigned, vid)
+				}
+				if len(unassigned) > 0 {
+					var vids []string
+					for vid := range unassigned {
+						vids = append(vids, vid)
+					}
+					sort.Strings(vids)
+					stdLog.Warnf("%d end-node(s) are stored without a gateway and not transferred: %v. give them by --node-vid to transfer them.\n", len(vids), vids)
+				}
+				sort.Slice(nodes, func(i, j int) bool { return nodes[i].VID < nodes[j].VID })
+				things = append(things, nodes...)
+
+				a := startAudit(c, "owner-transfer")
+				a.Target(owner)
+				// Add the new owner to every thing before removing the
+				// current one, so that no thing is left without the
+				// new owner.
+				failed := 0
+				for _, t := range things {
+					if err := _addThingOwner(gCtx, app, user, t.ID, owner); err != nil {
+						failed++
+						fmt.Printf("  failed to add    %s: %v\n", t.VID, err)
+						continue
+					}
+					fmt.Printf("  added            %s\n", t.VID)
+					stepCompleted("owner-transfer add " + t.VID)
+				}
+				if failed > 0 {
+					a.Fatal(failed, " thing(s) failed. the login user is kept as the owner. execute owner transfer again")
+				}
+				for _, n := range nodes {
+					if err := updateNodeRecord(appName, n.VID, func(r *NodeRecord) { r.Owner = owner }); err != nil {
+						stdLog.Errorln("failed to store end-node: ", err)
+					}
+				}
+				if c.Bool("keep-current") {
+					a.Done()
+					return
+				}
+				// Remove from the end-nodes first, the gateway last.
+				for i := len(things) - 1; i >= 0; i-- {
+					t := things[i]
+					if err := _removeOwner(gCtx, app, user, t.ID, "user:"+user.ID); err != nil {
+						failed++
+						fmt.Printf("  failed to remove %s: %v\n", t.VID, err)
+						continue
+					}
+					fmt.Printf("  removed          %s\n", t.VID)
+				}
+				if failed > 0 {
+					a.Fatal(failed, " thing(s) still have the login user as an owner. remove it by owner remove")
+				}
+				a.Done()
+			},
+		},
+	},
+}
+
+// ownershipTarget returns the thing id given by --node-vid, or the stored
+// gateway, and its name for the audit.
+func ownershipTarget(c *cli.Context, appName string) (thingID string, target string) {
+	if vid := c.String("node-vid"); vid != "" {
+		r := mustNodeRecord(appName, vid)
+		return r.ThingID, r.VID
+	}
+	id := storedGatewayID(gatewayKey(c, appName))
+	if id == "" {
+		stdLog.Fatalln("no gateway-id is stored. please execute onboard-gateway.")
+	}
+	return id, id
+}
+
+// mustResolveOwner returns the owner as user:<user id> or group:<group id>.
+// Other owners are taken as login names of Kii users.
+func mustResolveOwner(app App, user User, owner string) string {
+	if owner == "" {
+		stdLog.Fatalln("no owner is specified")
+	}
+	if strings.HasPrefix(owner, "user:") || strings.HasPrefix(owner, "group:") {
+		return owner
+	}
+	id, err := _getUserID(gCtx, app, user, owner)
+	if err != nil {
+		stdLog.Fatalln("failed to look up the owner: ", err)
+	}
+	return "user:" + id
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ThingTypeProfile constrains and completes the end-nodes of a thing type.
+// Profiles are configured in thing-types of the config file keyed by the
+// thing type.
+type ThingTypeProfile struct {
+	// FirmwareVersions are the versions allowed. Any version is allowed
+	// when empty.
+	FirmwareVersions []string `yaml:"firmware-versions"`
+	// DefaultFirmware is used when --node-fv is not given.
+	DefaultFirmware string `yaml:"default-firmware"`
+	// VIDPattern is the regexp the vendor thing id must match.
+	VIDPattern string `yaml:"vid-pattern"`
+	// PasswordPolicy constrains the end-node passwords.
+	PasswordPolicy PasswordPolicy `yaml:"password-policy"`
+	// CommandSchema fills schema and schemaVersion of commands posted to
+	// the end-nodes when they are not given.
+	CommandSchema CommandSchema `yaml:"command-schema"`
+	// Traits makes post-command post trait commands to the end-nodes.
+	Traits bool `yaml:"traits"`
+}
+
+type PasswordPolicy struct {
+	MinLength int    `yaml:"min-length"`
+	Pattern   string `yaml:"pattern"`
+}
+
+type CommandSchema struct {
+	Name    string `yaml:"name"`
+	Version int    `yaml:"version"`
+}
+
+// thingTypeProfile returns the profile of the thing type. It fails when
+// profiles are configured and the thing type is not one of them. ok is false
+// when no profile is configured.
+func thingTypeProfile(thingType string) (profile ThingTypeProfile, ok bool, err error) {
+	if len(gConfig.ThingTypes) == 0 {
+		return ThingTypeProfile{}, false, nil
+	}
+	if thingType == "" {
+		return ThingTypeProfile{}, false, fmt.Errorf("no thing type is given. available thing types: %s", strings.Join(thingTypeNames(gConfig.ThingTypes), ", "))
+	}
+	profile, ok = gConfig.ThingTypes[thingType]
+	if !ok {
+		return ThingTypeProfile{}, false, fmt.Errorf("thing type %q is not configured. available thing types: %s", thingType, strings.Join(thingTypeNames(gConfig.ThingTypes), ", "))
+	}
+	return profile, true, nil
+}
+
+// firmware returns the firmware version fv, or the default one when fv is
+// empty, and checks it is allowed.
+func (p ThingTypeProfile) firmware(fv string) (string, error) {
+	if fv == "" {
+		fv = p.DefaultFirmware
+	}
+	if len(p.FirmwareVersions) == 0 {
+		return fv, nil
+	}
+	for _, v := range p.FirmwareVersions {
+		if v == fv {
+			return fv, nil
+		}
+	}
+	return "", fmt.Errorf("firmware version %q is not allowed. allowed versions: %s", fv, strings.Join(p.FirmwareVersions, ", "))
+}
+
+func (p ThingTypeProfile) validateVID(vid string) error {
+	if p.VIDPattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(p.VIDPattern)
+	if err != nil {
+		return err
+	}
+	if !re.MatchString(vid) {
+		return fmt.Errorf("vendor thing id %q doesn't match %s", vid, p.VIDPattern)
+	}
+	return nil
+}
+
+func (p ThingTypeProfile) validatePassword(password string) error {
+	if len(password) < p.PasswordPolicy.MinLength {
+		return fmt.Errorf("password is shorter than %d characters", p.PasswordPolicy.MinLength)
+	}
+	if p.PasswordPolicy.Pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(p.PasswordPolicy.Pattern)
+	if err != nil {
+		return err
+	}
+	if !re.MatchString(password) {
+		return fmt.Errorf("password doesn't match %s", p.PasswordPolicy.Pattern)
+	}
+	return nil
+}
+
+// completeCommand fills schema and schemaVersion of the command when they
+// are not given.
+func (p ThingTypeProfile) completeCommand(command []byte) ([]byte, error) {
+	if p.CommandSchema.Name == "" {
+		return command, nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(command, &m); err != nil {
+		return nil, err
+	}
+	if _, ok := m["schema"]; !ok {
+		m["schema"] = p.CommandSchema.Name
+	}
+	if _, ok := m["schemaVersion"]; !ok {
+		m["schemaVersion"] = p.CommandSchema.Version
+	}
+	return json.Marshal(m)
+}
+
+// thingTypeNames returns the names of thing types in sorted order.
+func thingTypeNames(profiles map[string]ThingTypeProfile) []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateThingTypes(profiles map[string]ThingTypeProfile) []string {
+	var problems []string
+	for _, name := range thingTypeNames(profiles) {
+		p := profiles[name]
+		path := "thing-types." + name
+		if p.VIDPattern != "" {
+			if _, err := regexp.Compile(p.VIDPattern); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: vid-pattern: %v", path, err))
+			}
+		}
+		if p.PasswordPolicy.Pattern != "" {
+			if _, err := regexp.Compile(p.PasswordPolicy.Pattern); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: password-policy.pattern: %v", path, err))
+			}
+		}
+		if p.PasswordPolicy.MinLength < 0 {
+			problems = append(problems, fmt.Sprintf("%s: password-policy.min-length %d is negative", path, p.PasswordPolicy.MinLength))
+		}
+		if p.DefaultFirmware != "" {
+			if _, err := p.firmware(p.DefaultFirmware); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: default-firmware: %v", path, err))
+			}
+		}
+		if p.CommandSchema.Name != "" && p.Traits {
+			problems = append(problems, fmt.Sprintf("%s: command-schema and traits can't be used together", path))
+		}
+	}
+	return problems
+}
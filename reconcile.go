@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/codegangsta/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Places where end-nodes are recorded.
+const (
+	placeDB    = "db"
+	placeAgent = "agent"
+	placeCloud = "cloud"
+)
+
+var places = []string{placeDB, placeAgent, placeCloud}
+
+// Repair policies of reconcile. The place named by the policy is treated as
+// the source of truth.
+const (
+	policyCloud = "cloud"
+	policyDB    = "db"
+)
+
+// Drift is a disagreement between the places found by reconcile.
+type Drift struct {
+	// Kind is one of missing, unknown, id-mismatch, vid-mismatch and
+	// stale-gateway.
+	Kind   string
+	VID    string
+	Detail string
+}
+
+// Repair is an action planned by reconcile.
+type Repair struct {
+	// Kind is one of db-put, db-delete and agent-map.
+	Kind   string
+	Node   Node
+	Reason string
+}
+
+// nodeSets are the end-nodes of each place keyed by vendor thing id. A place
+// not examined is nil.
+type nodeSets map[string]map[string]string
+
+func (s nodeSets) vids() []string {
+	seen := map[string]bool{}
+	var vids []string
+	for _, m := range s {
+		for vid := range m {
+			if !seen[vid] {
+				seen[vid] = true
+				vids = append(vids, vid)
+			}
+		}
+	}
+	sort.Strings(vids)
+	return vids
+}
+
+// diffNodes returns the drifts between the places. unassigned are the
+// end-nodes stored in the DB without a gateway. They may belong to another
+// gateway, so their absence elsewhere is reported as unknown.
+func diffNodes(s nodeSets, unassigned map[string]bool) []Drift {
+	var drifts []Drift
+	for _, vid := range s.vids() {
+		var present, missing []string
+		ids := map[string]bool{}
+		var desc []string
+		for _, p := range places {
+			m, examined := s[p]
+			if !examined {
+				continue
+			}
+			if id, ok := m[vid]; ok {
+				present = append(present, p)
+				ids[id] = true
+				desc = append(desc, p+"="+id)
+			} else {
+				missing = append(missing, p)
+			}
+		}
+		if len(missing) > 0 && unassigned[vid] {
+			drifts = append(drifts, Drift{
+				Kind:   "unknown",
+				VID:    vid,
+				Detail: "stored without a gateway and not on " + strings.Join(missing, ", ") + ". it may belong to another gateway",
+			})
+		} else if len(missing) > 0 {
+			drifts = append(drifts, Drift{
+				Kind:   "missing",
+				VID:    vid,
+				Detail: "on " + strings.Join(present, ", ") + " but not on " + strings.Join(missing, ", "),
+			})
+		}
+		if len(ids) > 1 {
+			drifts = append(drifts, Drift{
+				Kind:   "id-mismatch",
+				VID:    vid,
+				Detail: strings.Join(desc, " "),
+			})
+		}
+	}
+
+	// The same thing with different vendor thing ids, e.g. replace-node
+	// updated Kii Cloud but failed on Gateway Agent.
+	vidsByID := map[string]map[string][]string{}
+	for _, p := range places {
+		for vid, id := range s[p] {
+			if vidsByID[id] == nil {
+				vidsByID[id] = map[string][]string{}
+			}
+			vidsByID[id][vid] = append(vidsByID[id][vid], p)
+		}
+	}
+	var ids []string
+	for id, v := range vidsByID {
+		if len(v) > 1 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		var desc []string
+		var vids []string
+		for vid, ps := range vidsByID[id] {
+			vids = append(vids, vid)
+			desc = append(desc, strings.Join(ps, ",")+"="+vid)
+		}
+		sort.Strings(vids)
+		sort.Strings(desc)
+		drifts = append(drifts, Drift{
+			Kind:   "vid-mismatch",
+			VID:    strings.Join(vids, "|"),
+			Detail: "thing " + id + ": " + strings.Join(desc, " "),
+		})
+	}
+	return drifts
+}
+
+// planRepairs returns the repairs to make the other places agree with the
+// source of truth named by policy. Things on Kii Cloud are never changed and
+// mappings on Gateway Agent are never removed, the drifts needing them are
+// left to the operator. The end-nodes in unassigned, stored without a gateway,
+// are repaired only when Kii Cloud shows they are under the gateway.
+func planRepairs(s nodeSets, unassigned map[string]bool, policy string) []Repair {
+	var repairs []Repair
+	truth := s[policy]
+	for _, vid := range s.vids() {
+		id, ok := truth[vid]
+		if unassigned[vid] && (policy != policyCloud || !ok) {
+			continue
+		}
+		if !ok {
+			if _, inDB := s[placeDB][vid]; policy == policyCloud && inDB {
+				repairs = append(repairs, Repair{Kind: "db-delete", Node: Node{VID: vid, ID: s[placeDB][vid]}, Reason: "not on cloud"})
+			}
+			continue
+		}
+		node := Node{ID: id, VID: vid}
+		if policy != policyDB && s[placeDB][vid] != id {
+			repairs = append(repairs, Repair{Kind: "db-put", Node: node, Reason: "db differs from " + policy})
+		} else if policy != policyDB && unassigned[vid] {
+			repairs = append(repairs, Repair{Kind: "db-put", Node: node, Reason: "db has no gateway"})
+		}
+		if s[placeAgent] != nil && s[placeAgent][vid] != id {
+			repairs = append(repairs, Repair{Kind: "agent-map", Node: node, Reason: "agent differs from " + policy})
+		}
+	}
+	return repairs
+}
+
+func applyRepair(ctx context.Context, r Repair, appName string, gatewayID string, app App, addr GatewayAddress, token string) error {
+	switch r.Kind {
+	case "db-put":
+		return updateNodeRecord(appName, r.Node.VID, func(rec *NodeRecord) {
+			rec.ThingID, rec.Gateway = r.Node.ID, gatewayID
+		})
+	case "db-delete":
+		return db.Update(func(tx *bolt.Tx) error {
+			return deleteNodeRecord(tx, appName, r.Node.VID)
+		})
+	case "agent-map":
+		return _mapNode(ctx, addr, app, r.Node, token)
+	}
+	return fmt.Errorf("unknown repair %s", r.Kind)
+}
+
+// confirm asks y/N on the terminal.
+func confirm(question string) bool {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Fprint(os.Stderr, question+" [y/N]: ")
+	line, _ := readRawLine(os.Stdin)
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+var reconcile = cli.Command{
+	Name:  "reconcile",
+	Usage: "reconcile [--fix [--policy cloud|db] [--yes]] [--skip-cloud] --app-name <app name>",
+	UsageText: `Compare end-nodes stored in the DB, mapped on Gateway Agent and registered under the gateway on Kii Cloud.
+	Prints orphans, mismatched thing ids or vendor thing ids and stale gateway id.
+	With --fix, prints the repair plan and applies it after confirmation.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "app-name",
+		},
+		userFlag,
+		cli.BoolFlag{
+			Name:  "fix",
+			Usage: "Repair the drifts according to --policy",
+		},
+		cli.StringFlag{
+			Name:  "policy",
+			Value: policyCloud,
+			Usage: "Source of truth to repair the others. cloud: update the DB and Gateway Agent to match Kii Cloud. db: update Gateway Agent to match the DB",
+		},
+		cli.BoolFlag{
+			Name:  "yes",
+			Usage: "Apply the repair plan without confirmation",
+		},
+		cli.BoolFlag{
+			Name:  "skip-cloud",
+			Usage: "Compare only the DB and Gateway Agent",
+		},
+	},
+	Action: func(c *cli.Context) {
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
+		addr := gatewayAddress(c)
+		policy := c.String("policy")
+		if policy != policyCloud && policy != policyDB {
+			stdLog.Fatalf("unknown policy %s. available policies: %s, %s\n", policy, policyCloud, policyDB)
+		}
+		if policy == policyCloud && c.Bool("skip-cloud") && c.Bool("fix") {
+			stdLog.Fatalln("policy cloud can't be used with --skip-cloud")
+		}
+		token := storedToken(gwKey)
+		if token == "" {
+			stdLog.Fatalln("token is not stored for the specified app. execute auth.")
+		}
+
+		gatewayID := storedGatewayID(gwKey)
+		sets := nodeSets{}
+		var drifts []Drift
+		dbNodes, unassignedNodes, err := gatewayNodes(appName, gatewayID)
+		if err != nil {
+			stdLog.Fatalln("failed to read end-nodes from db: ", err)
+		}
+		sets[placeDB] = map[string]string{}
+		for vid, n := range dbNodes {
+			sets[placeDB][vid] = n.ID
+		}
+		unassigned := map[string]bool{}
+		for vid, n := range unassignedNodes {
+			sets[placeDB][vid] = n.ID
+			unassigned[vid] = true
+		}
+		agentNodes, err := _listOnboardedNodes(gCtx, addr, app, token)
+		if err != nil {
+			stdLog.Fatalln("failed to list end-nodes on Gateway Agent: ", err)
+		}
+		sets[placeAgent] = map[string]string{}
+		for _, n := range agentNodes {
+			sets[placeAgent][n.VID] = n.ID
+		}
+		if !c.Bool("skip-cloud") {
+			cloudNodes, stale := listCloudNodes(gCtx, appName, gwKey, app, mustUser(c, appName))
+			if stale != nil {
+				drifts = append(drifts, *stale)
+			} else {
+				sets[placeCloud] = map[string]string{}
+				for _, n := range cloudNodes {
+					sets[placeCloud][n.VID] = n.ID
+				}
+			}
+		}
+		drifts = append(drifts, diffNodes(sets, unassigned)...)
+
+		if len(drifts) == 0 {
+			fmt.Println("no drift is found.")
+			return
+		}
+		fmt.Printf("%d drift(s) found:\n", len(drifts))
+		for _, d := range drifts {
+			fmt.Printf("  %-13s %s: %s\n", d.Kind, d.VID, d.Detail)
+		}
+		if !c.Bool("fix") {
+			return
+		}
+		if sets[policy] == nil {
+			stdLog.Fatalln("can't repair with policy ", policy, ": ", policy, " is not examined")
+		}
+		repairs := planRepairs(sets, unassigned, policy)
+		if len(repairs) == 0 {
+			fmt.Println("nothing can be repaired automatically with policy", policy)
+			return
+		}
+		fmt.Printf("repair plan (policy %s):\n", policy)
+		for _, r := range repairs {
+			fmt.Printf("  %-9s %s -> %s (%s)\n", r.Kind, r.Node.VID, r.Node.ID, r.Reason)
+		}
+		if !c.Bool("yes") && !confirm("apply the plan?") {
+			stdLog.Fatalln("aborted. specify --yes to apply without confirmation.")
+		}
+		a := startAudit(c, "reconcile")
+		a.Target(policy)
+		failed := 0
+		for _, r := range repairs {
+			err := applyRepair(gCtx, r, appName, gatewayID, app, addr, token)
+			if err != nil {
+				failed++
+				fmt.Printf("  failed %s %s: %v\n", r.Kind, r.Node.VID, err)
+				continue
+			}
+			fmt.Printf("  done   %s %s\n", r.Kind, r.Node.VID)
+			stepCompleted(r.Kind + " " + r.Node.VID)
+		}
+		if failed > 0 {
+			a.Fatal(failed, " repair(s) failed")
+		}
+		a.Done()
+	},
+}
+
+// listCloudNodes lists end-nodes of the stored gateway on Kii Cloud. It
+// returns a drift instead when the stored gateway is not on Kii Cloud.
+func listCloudNodes(ctx context.Context, appName string, gwKey string, app App, user User) ([]Node, *Drift) {
+	gatewayID := storedGatewayID(gwKey)
+	if gatewayID == "" {
+		stdLog.Fatalln("no gateway-id is stored. execute onboard-gateway or --skip-cloud.")
+	}
+	exists, err := _thingExists(ctx, app, user, gatewayID)
+	if err != nil {
+		stdLog.Fatalln("failed to get the gateway from Kii Cloud: ", err)
+	}
+	if !exists {
+		return nil, &Drift{
+			Kind:   "stale-gateway",
+			VID:    gwKey,
+			Detail: "gateway " + gatewayID + " is not on cloud. execute setup-gateway --from onboard-gateway",
+		}
+	}
+	nodes, err := _listCloudEndNodes(ctx, app, user, gatewayID)
+	if err != nil {
+		stdLog.Fatalln("failed to list end-nodes on Kii Cloud: ", err)
+	}
+	return nodes, nil
+}
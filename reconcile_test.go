@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffNodes(t *testing.T) {
+	sets := nodeSets{
+		placeDB:    {"a": "th-a", "b": "th-b", "c": "th-c", "old": "th-old"},
+		placeAgent: {"a": "th-a", "b": "th-x", "d": "th-c", "old": "th-old"},
+		placeCloud: {"a": "th-a", "b": "th-b", "d": "th-c"},
+	}
+	got := diffNodes(sets, map[string]bool{"old": true})
+	want := []Drift{
+		{Kind: "id-mismatch", VID: "b", Detail: "db=th-b agent=th-x cloud=th-b"},
+		{Kind: "missing", VID: "c", Detail: "on db but not on agent, cloud"},
+		{Kind: "missing", VID: "d", Detail: "on agent, cloud but not on db"},
+		{Kind: "unknown", VID: "old", Detail: "stored without a gateway and not on cloud. it may belong to another gateway"},
+		{Kind: "vid-mismatch", VID: "c|d", Detail: "thing th-c: agent,cloud=d db=c"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffNodes() =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestDiffNodesNotExamined(t *testing.T) {
+	sets := nodeSets{
+		placeDB:    {"a": "th-a"},
+		placeAgent: {"a": "th-a"},
+	}
+	if got := diffNodes(sets, nil); len(got) != 0 {
+		t.Errorf("diffNodes() = %v, want no drift", got)
+	}
+}
+
+func TestPlanRepairs(t *testing.T) {
+	sets := nodeSets{
+		placeDB:    {"a": "th-a", "b": "th-b", "c": "th-c", "old": "th-old", "moved": "th-moved"},
+		placeAgent: {"a": "th-a", "b": "th-x", "old": "th-old"},
+		placeCloud: {"a": "th-a", "b": "th-b", "d": "th-d", "moved": "th-moved"},
+	}
+	unassigned := map[string]bool{"old": true, "moved": true}
+	tests := []struct {
+		policy string
+		want   []Repair
+	}{
+		{
+			policy: policyCloud,
+			want: []Repair{
+				{Kind: "agent-map", Node: Node{ID: "th-b", VID: "b"}, Reason: "agent differs from cloud"},
+				{Kind: "db-delete", Node: Node{ID: "th-c", VID: "c"}, Reason: "not on cloud"},
+				{Kind: "db-put", Node: Node{ID: "th-d", VID: "d"}, Reason: "db differs from cloud"},
+				{Kind: "agent-map", Node: Node{ID: "th-d", VID: "d"}, Reason: "agent differs from cloud"},
+				{Kind: "db-put", Node: Node{ID: "th-moved", VID: "moved"}, Reason: "db has no gateway"},
+				{Kind: "agent-map", Node: Node{ID: "th-moved", VID: "moved"}, Reason: "agent differs from cloud"},
+			},
+		},
+		{
+			policy: policyDB,
+			want: []Repair{
+				{Kind: "agent-map", Node: Node{ID: "th-b", VID: "b"}, Reason: "agent differs from db"},
+				{Kind: "agent-map", Node: Node{ID: "th-c", VID: "c"}, Reason: "agent differs from db"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := planRepairs(sets, unassigned, tt.policy)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("planRepairs(%s) =\n%v\nwant\n%v", tt.policy, got, tt.want)
+		}
+		for _, r := range got {
+			if unassigned[r.Node.VID] && r.Kind == "db-delete" {
+				t.Errorf("planRepairs(%s) deletes %s stored without a gateway", tt.policy, r.Node.VID)
+			}
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/codegangsta/cli"
+)
+
+// GatewayReplacement is the progress of replace-gateway stored in the
+// gateway-replacements bucket. The key is the same as the tokens bucket.
+type GatewayReplacement struct {
+	OldGatewayID string                  `json:"oldGatewayID"`
+	NewGatewayID string                  `json:"newGatewayID"`
+	OwnerAdded   bool                    `json:"ownerAdded"`
+	OwnerRemoved bool                    `json:"ownerRemoved"`
+	Nodes        map[string]NodeProgress `json:"nodes"`
+	StartedAt    time.Time               `json:"startedAt"`
+	CompletedAt  time.Time               `json:"completedAt,omitempty"`
+}
+
+// NodeProgress is the progress of moving an end-node to the new gateway.
+type NodeProgress struct {
+	ID         string `json:"id"`
+	Registered bool   `json:"registered"`
+	Mapped     bool   `json:"mapped"`
+	Error      string `json:"error,omitempty"`
+}
+
+func loadReplacement(gwKey string) (*GatewayReplacement, error) {
+	var r *GatewayReplacement
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("gateway-replacements")).Get([]byte(gwKey))
+		if v == nil {
+			return nil
+		}
+		r = &GatewayReplacement{}
+		return json.Unmarshal(v, r)
+	})
+	return r, err
+}
+
+func storeReplacement(gwKey string, r *GatewayReplacement) {
+	j, _ := json.Marshal(r)
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("gateway-replacements")).Put([]byte(gwKey), j)
+	})
+	if err != nil {
+		stdLog.Fatalln("failed to store progress of replace-gateway: ", err)
+	}
+}
+
+var replaceGateway = cli.Command{
+	Name:  "replace-gateway",
+	Usage: "replace-gateway [--keep-old-owner] [--include-unassigned] [--restart] --app-name <app name>",
+	UsageText: `Replace gateway hardware with new one.
+	Execute auth against the new Gateway Agent before this command.
+	Onboards the new gateway, adds the owner, registers every end-node of the old gateway under
+	the new gateway on Kii Cloud, maps them on the new Gateway Agent and removes the owner from the old gateway.
+	Progress is stored in the DB, so the command can be executed again to resume after a failure.`,
+	Flags: joinFlags(
+		[]cli.Flag{
+			cli.StringFlag{
+				Name: "app-name",
+			},
+			userFlag,
+			cli.BoolFlag{
+				Name:  "master",
+				Usage: "Onboard the new gateway as master gateway",
+			},
+			cli.BoolFlag{
+				Name:  "keep-old-owner",
+				Usage: "Don't remove the owner from the old gateway",
+			},
+			cli.BoolFlag{
+				Name:  "include-unassigned",
+				Usage: "Also move the end-nodes stored without a gateway, e.g. by older versions",
+			},
+			cli.BoolFlag{
+				Name:  "restart",
+				Usage: "Start a new replacement even if the previous one is completed",
+			},
+		},
+		secretFlags("gateway-password", "Password of the new gateway. It is configured in coonfig file of Gateway Agent"),
+		secretFlags("node-password", "end node password. Used for every end-node, the credential helper or the prompt is asked per end-node when not given"),
+	),
+	Action: func(c *cli.Context) {
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
+		addr := gatewayAddress(c)
+
+		r, err := loadReplacement(gwKey)
+		if err != nil {
+			stdLog.Fatalln("failed to read progress of replace-gateway: ", err)
+		}
+		if r != nil && !r.CompletedAt.IsZero() && !c.Bool("restart") {
+			stdLog.Printf("replace-gateway is already completed at %s: %s -> %s. specify --restart to replace again.\n",
+				r.CompletedAt.Format(time.RFC3339), r.OldGatewayID, r.NewGatewayID)
+			return
+		}
+		if r == nil || !r.CompletedAt.IsZero() {
+			oldID := storedGatewayID(gwKey)
+			if oldID == "" {
+				stdLog.Fatalln("no gateway-id is stored. execute setup-gateway for a new gateway.")
+			}
+			r = &GatewayReplacement{
+				OldGatewayID: oldID,
+				Nodes:        map[string]NodeProgress{},
+				StartedAt:    time.Now(),
+			}
+			storeReplacement(gwKey, r)
+		}
+		user := mustUser(c, appName)
+		token := storedToken(gwKey)
+		if token == "" {
+			stdLog.Fatalln("token is not stored for the specified app. execute auth against the new Gateway Agent.")
+		}
+
+		a := startAudit(c, "replace-gateway")
+		a.Target(fmt.Sprintf("%s:%d", addr.Host, addr.Port))
+		a.ID("oldGatewayID", r.OldGatewayID)
+		if r.NewGatewayID == "" {
+			id, err := doOnboardGateway(gCtx, addr, gwKey, app, c.Bool("master"))
+			if err != nil {
+				a.Fatal(err)
+			}
+			if id == r.OldGatewayID {
+				a.Fatal("the new Gateway Agent is onboarded as the old gateway ", id+". use restore when the hardware is not replaced.")
+			}
+			r.NewGatewayID = id
+			storeReplacement(gwKey, r)
+		}
+		stdLog.Printf("gateway: %s -> %s\n", r.OldGatewayID, r.NewGatewayID)
+		a.ID("gatewayID", r.NewGatewayID)
+
+		if !r.OwnerAdded {
+			password, err := readSecret(c, "gateway-password", secretGatewayThing, appName, r.NewGatewayID)
+			if err != nil {
+				a.Fatal(err)
+			}
+			err = doAddOwner(gCtx, gwKey, app, user, password)
+			if err != nil {
+				a.Fatal(err)
+			}
+			r.OwnerAdded = true
+			storeReplacement(gwKey, r)
+		}
+
+		failed := moveNodes(gCtx, c, appName, gwKey, app, addr, user, token, r)
+		if failed > 0 {
+			a.Fatal(failed, " end-node(s) are not moved to the new gateway. execute replace-gateway again to resume.")
+		}
+		// The owner is removed from the old gateway last so that the old
+		// gateway can still be managed while any end-node is not moved.
+		if !r.OwnerRemoved && !c.Bool("keep-old-owner") {
+			err := _removeOwner(gCtx, app, user, r.OldGatewayID, "user:"+user.ID)
+			if err != nil {
+				a.Fatal("failed to remove the owner from the old gateway: ", err)
+			}
+			r.OwnerRemoved = true
+			storeReplacement(gwKey, r)
+		}
+		r.CompletedAt = time.Now()
+		storeReplacement(gwKey, r)
+		a.Done()
+		stdLog.Println("replace-gateway is completed.")
+	},
+}
+
+// moveNodes registers the end-nodes of the old gateway under the new gateway
+// and maps them on the new Gateway Agent. End-nodes stored without a gateway
+// are moved only with --include-unassigned. It returns the number of
+// end-nodes failed.
+func moveNodes(ctx context.Context, c *cli.Context, appName string, gwKey string, app App, addr GatewayAddress, user User, token string, r *GatewayReplacement) int {
+	nodes, unassigned, err := gatewayNodes(appName, r.OldGatewayID)
+	if err != nil {
+		stdLog.Fatalln("failed to read end-nodes from db: ", err)
+	}
+	// End-nodes already registered under the new gateway by the previous
+	// execution are resumed.
+	moved, _, err := gatewayNodes(appName, r.NewGatewayID)
+	if err != nil {
+		stdLog.Fatalln("failed to read end-nodes from db: ", err)
+	}
+	for vid, n := range moved {
+		if _, ok := r.Nodes[vid]; ok {
+			nodes[vid] = n
+		}
+	}
+	var skipped []string
+	for vid, n := range unassigned {
+		if _, ok := r.Nodes[vid]; ok || c.Bool("include-unassigned") {
+			nodes[vid] = n
+		} else {
+			skipped = append(skipped, vid)
+		}
+	}
+	if len(skipped) > 0 {
+		sort.Strings(skipped)
+		stdLog.Warnf("%d end-node(s) are stored without a gateway and not moved: %v. specify --include-unassigned to move them.\n", len(skipped), skipped)
+	}
+	var vids []string
+	for vid := range nodes {
+		vids = append(vids, vid)
+	}
+	sort.Strings(vids)
+	failed := 0
+	for i, vid := range vids {
+		p := r.Nodes[vid]
+		if p.ID == "" {
+			p.ID = nodes[vid].ID
+		}
+		prefix := fmt.Sprintf("[%d/%d] %s:", i+1, len(vids), vid)
+		if p.Registered && p.Mapped {
+			stdLog.Println(prefix, "already moved. skipped.")
+			continue
+		}
+		err := moveNode(ctx, c, appName, app, addr, user, token, r.NewGatewayID, vid, &p)
+		if err != nil {
+			p.Error = err.Error()
+			failed++
+			stdLog.Warnln(prefix, err)
+		} else {
+			p.Error = ""
+			stdLog.Println(prefix, "moved.")
+			stepCompleted("move " + vid)
+		}
+		r.Nodes[vid] = p
+		storeReplacement(gwKey, r)
+	}
+	return failed
+}
+
+func moveNode(ctx context.Context, c *cli.Context, appName string, app App, addr GatewayAddress, user User, token string, gatewayID string, vid string, p *NodeProgress) error {
+	if !p.Registered {
+		password, err := readSecret(c, "node-password", secretNode, appName, vid)
+		if err != nil {
+			return err
+		}
+		var thingType, firmware string
+		if rec, err := storedNodeRecord(appName, vid); err == nil && rec != nil {
+			thingType, firmware = rec.ThingType, rec.Firmware
+		}
+		id, err := _onboardNode(ctx, app, user, gatewayID, vid, password, thingType, firmware)
+		if err != nil {
+			return fmt.Errorf("failed to register under the new gateway: %v", err)
+		}
+		if id != p.ID {
+			stdLog.Printf("%s: thing id is changed %s -> %s\n", vid, p.ID, id)
+		}
+		err = updateNodeRecord(appName, vid, func(r *NodeRecord) {
+			r.ThingID, r.Gateway = id, gatewayID
+		})
+		if err != nil {
+			return fmt.Errorf("failed to store end-node: %v", err)
+		}
+		p.ID = id
+		p.Registered = true
+	}
+	err := _mapNode(ctx, addr, app, Node{ID: p.ID, VID: vid}, token)
+	if err != nil {
+		return fmt.Errorf("failed to map end-node: %v", err)
+	}
+	p.Mapped = true
+	return nil
+}
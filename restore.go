@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// MappingReport is the result of verifying end-node mappings on Gateway Agent
+// against the DB.
+type MappingReport struct {
+	// Consistent are the end-nodes mapped as stored in the DB.
+	Consistent []Node
+	// Remapped are the end-nodes mapped again by this verification.
+	Remapped []Node
+	// Failed are the end-nodes failed to be mapped again keyed by vendor thing
+	// id.
+	Failed map[string]error
+	// Unknown are the end-nodes mapped on Gateway Agent but not stored in the
+	// DB.
+	Unknown []Node
+	// Unassigned are the end-nodes stored without a gateway and not mapped on
+	// Gateway Agent. They are not mapped since they may belong to another
+	// gateway.
+	Unassigned []Node
+}
+
+// Print writes the report in human readable form.
+func (r MappingReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "consistent: %d, remapped: %d, failed: %d, unknown to db: %d, no gateway in db: %d\n",
+		len(r.Consistent), len(r.Remapped), len(r.Failed), len(r.Unknown), len(r.Unassigned))
+	for _, n := range r.Remapped {
+		fmt.Fprintf(w, "  remapped  %s -> %s\n", n.VID, n.ID)
+	}
+	var vids []string
+	for vid := range r.Failed {
+		vids = append(vids, vid)
+	}
+	sort.Strings(vids)
+	for _, vid := range vids {
+		fmt.Fprintf(w, "  failed    %s: %v\n", vid, r.Failed[vid])
+	}
+	for _, n := range r.Unknown {
+		fmt.Fprintf(w, "  unknown   %s -> %s\n", n.VID, n.ID)
+	}
+	for _, n := range r.Unassigned {
+		fmt.Fprintf(w, "  no gateway %s -> %s. map it by replace-node or onboard-node if it belongs to this gateway\n", n.VID, n.ID)
+	}
+}
+
+// waitForAgent polls the end-node mappings of Gateway Agent until it
+// responds or timeout elapses.
+func waitForAgent(ctx context.Context, addr GatewayAddress, app App, token string, timeout time.Duration, interval time.Duration) ([]Node, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		nodes, err := _listOnboardedNodes(ctx, addr, app, token)
+		if err == nil {
+			return nodes, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Gateway Agent didn't come back in %v: %v", timeout, err)
+		}
+		stdLog.Printf("waiting for Gateway Agent: %v\n", err)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// verifyNodeMappings compares mapped, the end-node mappings on Gateway Agent,
+// with the end-nodes of the gateway in the nodes:<app> bucket and maps the
+// missing or mismatched ones again. End-nodes stored without a gateway are
+// only reported.
+func verifyNodeMappings(ctx context.Context, addr GatewayAddress, appName string, gatewayID string, app App, token string, mapped []Node) MappingReport {
+	report := MappingReport{Failed: map[string]error{}}
+	stored, unassigned, err := gatewayNodes(appName, gatewayID)
+	if err != nil {
+		stdLog.Fatalln("failed to read end-nodes from db: ", err)
+	}
+	onAgent := map[string]Node{}
+	for _, n := range mapped {
+		onAgent[n.VID] = n
+		if u, ok := unassigned[n.VID]; ok && u.ID == n.ID {
+			report.Consistent = append(report.Consistent, u)
+			delete(unassigned, n.VID)
+			continue
+		}
+		if _, ok := stored[n.VID]; !ok {
+			report.Unknown = append(report.Unknown, n)
+		}
+	}
+	for _, n := range unassigned {
+		report.Unassigned = append(report.Unassigned, n)
+	}
+	sort.Slice(report.Unassigned, func(i, j int) bool { return report.Unassigned[i].VID < report.Unassigned[j].VID })
+	var vids []string
+	for vid := range stored {
+		vids = append(vids, vid)
+	}
+	sort.Strings(vids)
+	for _, vid := range vids {
+		node := stored[vid]
+		if n, ok := onAgent[vid]; ok && n.ID == node.ID {
+			report.Consistent = append(report.Consistent, node)
+			continue
+		}
+		err := _mapNode(ctx, addr, app, node, token)
+		if err != nil {
+			report.Failed[vid] = err
+			continue
+		}
+		report.Remapped = append(report.Remapped, node)
+	}
+	return report
+}
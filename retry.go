@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Targets of HTTP requests configured by the http section of the config.
+const (
+	targetGateway = "gateway"
+	targetCloud   = "cloud"
+)
+
+// HTTPConfig configures timeout and retry of requests per target.
+type HTTPConfig struct {
+	Gateway HTTPTarget `yaml:"gateway"`
+	Cloud   HTTPTarget `yaml:"cloud"`
+}
+
+// HTTPTarget configures requests to a target. Zero values are replaced with
+// the defaults.
+type HTTPTarget struct {
+	// Timeout of each attempt including reading the response body.
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is the max number of retries of idempotent requests. 0
+	// disables retry.
+	Retries *int `yaml:"retries"`
+	// Backoff is the initial interval of retries, doubled per retry.
+	Backoff time.Duration `yaml:"backoff"`
+	// MaxBackoff caps the interval of retries including Retry-After.
+	MaxBackoff time.Duration `yaml:"max-backoff"`
+}
+
+var defaultHTTPTargets = map[string]HTTPTarget{
+	targetGateway: {Timeout: 30 * time.Second, Retries: intPtr(3), Backoff: 500 * time.Millisecond, MaxBackoff: 30 * time.Second},
+	targetCloud:   {Timeout: 60 * time.Second, Retries: intPtr(3), Backoff: time.Second, MaxBackoff: time.Minute},
+}
+
+func intPtr(n int) *int {
+	return &n
+}
+
+// withDefaults returns t with the zero values replaced with the defaults of
+// the target.
+func (t HTTPTarget) withDefaults(target string) HTTPTarget {
+	d := defaultHTTPTargets[target]
+	if t.Timeout == 0 {
+		t.Timeout = d.Timeout
+	}
+	if t.Retries == nil {
+		t.Retries = d.Retries
+	}
+	if t.Backoff == 0 {
+		t.Backoff = d.Backoff
+	}
+	if t.MaxBackoff == 0 {
+		t.MaxBackoff = d.MaxBackoff
+	}
+	return t
+}
+
+func (c HTTPConfig) target(target string) HTTPTarget {
+	if target == targetCloud {
+		return c.Cloud.withDefaults(target)
+	}
+	return c.Gateway.withDefaults(target)
+}
+
+// targetOf tells whether req is sent to Kii Cloud or Gateway Agent.
+func targetOf(req *http.Request) string {
+	host := req.URL.Hostname()
+	for _, h := range knownSites {
+		if h == host {
+			return targetCloud
+		}
+	}
+	for _, app := range gConfig.Apps {
+		if app.Host == host {
+			return targetCloud
+		}
+	}
+	return targetGateway
+}
+
+// idempotentRequests are the requests to Gateway Agent known to be safe to
+// send again, given by the method and a match of the path.
+var idempotentRequests = []struct {
+	method string
+	match  func(path string) bool
+}{
+	// list-pending-nodes
+	{"GET", func(p string) bool { return strings.HasSuffix(p, "/gateway/end-nodes/pending") }},
+	// end-node mapping
+	{"PUT", func(p string) bool { return strings.Contains(p, "/gateway/end-nodes/VENDOR_THING_ID:") }},
+	// token fetch of auth
+	{"POST", func(p string) bool { return strings.HasSuffix(p, "/token") }},
+}
+
+// idempotent tells whether req can be sent again. Only the requests in
+// idempotentRequests are.
+func idempotent(req *http.Request) bool {
+	if targetOf(req) != targetGateway {
+		return false
+	}
+	for _, r := range idempotentRequests {
+		if r.method == req.Method && r.match(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransport applies the timeout per attempt and retries idempotent
+// requests failed by the transport or responded with 429 or 5xx with
+// exponential backoff and jitter.
+type retryTransport struct {
+	next   http.RoundTripper
+	config HTTPConfig
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// kii_go doesn't take a context, bind its requests to the command.
+	if req.Context() == context.Background() {
+		req = req.WithContext(gCtx)
+	}
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	conf := t.config.target(targetOf(req))
+	retries := *conf.Retries
+	if !idempotent(req) {
+		retries = 0
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := t.attempt(req, body, conf.Timeout)
+		if attempt >= retries || !retryable(res, err) || req.Context().Err() != nil {
+			return res, err
+		}
+		wait := backoff(conf, attempt, res)
+		if err != nil {
+			stdLog.Warnf("%s %s failed: %v. retry in %v (%d/%d)\n", req.Method, req.URL, err, wait, attempt+1, retries)
+		} else {
+			stdLog.Warnf("%s %s responded %d. retry in %v (%d/%d)\n", req.Method, req.URL, res.StatusCode, wait, attempt+1, retries)
+			res.Body.Close()
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func (t retryTransport) attempt(req *http.Request, body []byte, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	r := req.WithContext(ctx)
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	res, err := t.next.RoundTrip(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The timeout covers reading the body, cancel on close.
+	res.Body = cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusTooManyRequests || 500 <= res.StatusCode
+}
+
+// backoff returns the interval before the retry: Retry-After of res when
+// given, otherwise Backoff * 2^attempt with jitter, capped by MaxBackoff.
+func backoff(conf HTTPTarget, attempt int, res *http.Response) time.Duration {
+	if res != nil {
+		if d, ok := retryAfter(res.Header.Get("Retry-After")); ok {
+			if d > conf.MaxBackoff {
+				d = conf.MaxBackoff
+			}
+			return d
+		}
+	}
+	d := conf.Backoff << uint(attempt)
+	if d <= 0 || d > conf.MaxBackoff {
+		d = conf.MaxBackoff
+	}
+	// Equal jitter: half fixed and half random.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter parses Retry-After given in seconds or HTTP date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/codegangsta/cli"
+	"golang.org/x/crypto/scrypt"
+)
+
+// NodeSecret is the password of an end-node stored in the
+// node-passwords:<app> bucket keyed by vendor thing id. The passwords are
+// encrypted by the key in secret-key-file.
+type NodeSecret struct {
+	Password string `json:"password"`
+	// Pending is the new password while it is being rotated. Either of
+	// them is valid on Kii Cloud when the rotation is interrupted.
+	Pending   string    `json:"pending,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// secretKeyPath returns the path of the key encrypting the stored passwords.
+func secretKeyPath() string {
+	if gConfig.SecretKeyFile != "" {
+		return gConfig.SecretKeyFile
+	}
+	return dbPath(gConfig) + ".key"
+}
+
+// nodeSecretKey is the key loaded by loadSecretKey.
+var nodeSecretKey []byte
+
+// loadSecretKey reads the key. It is generated when create is true and the
+// file doesn't exist. With --dry-run, the generated key is not written.
+func loadSecretKey(create bool) ([]byte, error) {
+	if nodeSecretKey != nil {
+		return nodeSecretKey, nil
+	}
+	path := secretKeyPath()
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if !db.DryRun {
+			if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+				return nil, err
+			}
+			stdLog.Infoln("generated the key of stored passwords in", path)
+		}
+		nodeSecretKey = key
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s is not a 32 bytes key in hex", path)
+	}
+	nodeSecretKey = key
+	return key, nil
+}
+
+// seal encrypts plaintext with AES-GCM. The nonce is put before the cipher
+// text.
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key []byte, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptSecret(key []byte, s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	b, err := seal(key, []byte(s))
+	return base64.StdEncoding.EncodeToString(b), err
+}
+
+func decryptSecret(key []byte, s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	b, err = open(key, b)
+	if err != nil {
+		return "", errors.New("can't decrypt the stored password. is " + secretKeyPath() + " the right key?")
+	}
+	return string(b), nil
+}
+
+const passwordChars = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789-_.~!@#%+="
+
+// generatePassword returns a random password of 24 characters. It satisfies
+// the password policy of the profile when given.
+func generatePassword(profile *ThingTypeProfile) (string, error) {
+	length := 24
+	if profile != nil && profile.PasswordPolicy.MinLength > length {
+		length = profile.PasswordPolicy.MinLength
+	}
+	for i := 0; i < 100; i++ {
+		b := make([]byte, length)
+		for j := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passwordChars))))
+			if err != nil {
+				return "", err
+			}
+			b[j] = passwordChars[n.Int64()]
+		}
+		if profile == nil || profile.validatePassword(string(b)) == nil {
+			return string(b), nil
+		}
+	}
+	return "", errors.New("can't generate a password satisfying the password policy")
+}
+
+// storedNodeSecret returns the decrypted secret of the end-node, nil when it
+// is not stored.
+func storedNodeSecret(appName string, vid string) (*NodeSecret, error) {
+	var v []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("node-passwords:" + appName)); b != nil {
+			v = b.Get([]byte(vid))
+		}
+		return nil
+	})
+	if err != nil || v == nil {
+		return nil, err
+	}
+	var s NodeSecret
+	if err := json.Unmarshal(v, &s); err != nil {
+		return nil, err
+	}
+	key, err := loadSecretKey(false)
+	if err != nil {
+		return nil, err
+	}
+	if s.Password, err = decryptSecret(key, s.Password); err != nil {
+		return nil, err
+	}
+	if s.Pending, err = decryptSecret(key, s.Pending); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// storeNodeSecret encrypts and stores the secret of the end-node.
+func storeNodeSecret(appName string, vid string, s NodeSecret) error {
+	key, err := loadSecretKey(true)
+	if err != nil {
+		return err
+	}
+	if s.Password, err = encryptSecret(key, s.Password); err != nil {
+		return err
+	}
+	if s.Pending, err = encryptSecret(key, s.Pending); err != nil {
+		return err
+	}
+	s.UpdatedAt = time.Now()
+	v, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("node-passwords:" + appName))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(vid), v)
+	})
+}
+
+// deleteNodeSecret removes the secret of the end-node.
+func deleteNodeSecret(appName string, vid string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("node-passwords:" + appName)); b != nil {
+			return b.Delete([]byte(vid))
+		}
+		return nil
+	})
+}
+
+// stageNodePassword stores password as the pending password of the end-node
+// before it is set on Kii Cloud, so that it is not lost when the CLI is
+// interrupted.
+func stageNodePassword(appName string, vid string, password string) error {
+	s, err := storedNodeSecret(appName, vid)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		s = &NodeSecret{}
+	}
+	s.Pending = password
+	return storeNodeSecret(appName, vid, *s)
+}
+
+// rejectedByCloud reports whether err shows Kii Cloud rejected the request,
+// so that the password sent with it is certainly not set.
+func rejectedByCloud(err error) bool {
+	e, ok := err.(*CloudError)
+	return ok && 400 <= e.StatusCode && e.StatusCode < 500
+}
+
+// settleNodePassword settles the pending password of the end-node by the
+// result of setting it on Kii Cloud. It becomes the password when cloudErr is
+// nil and is dropped when Kii Cloud rejected it. Otherwise it is unknown
+// whether it is set, so it is kept pending for rotate-node-password.
+func settleNodePassword(appName string, vid string, cloudErr error) error {
+	s, err := storedNodeSecret(appName, vid)
+	if err != nil || s == nil {
+		return err
+	}
+	switch {
+	case cloudErr == nil:
+		s.Password = s.Pending
+	case !rejectedByCloud(cloudErr):
+		stdLog.Warnf("the new password of %s may be set on Kii Cloud. it is kept as pending. execute rotate-node-password --node-vid %s\n", vid, vid)
+		return nil
+	}
+	s.Pending = ""
+	if s.Password == "" {
+		return deleteNodeSecret(appName, vid)
+	}
+	return storeNodeSecret(appName, vid, *s)
+}
+
+// storedNodePassword returns the stored password of the end-node, empty
+// when it is not stored.
+func storedNodePassword(appName string, vid string) (string, error) {
+	s, err := storedNodeSecret(appName, vid)
+	if err != nil || s == nil {
+		return "", err
+	}
+	if s.Pending != "" {
+		stdLog.Warnf("rotation of the password of %s was interrupted. the new password may be valid instead. execute rotate-node-password --node-vid %s\n", vid, vid)
+	}
+	return s.Password, nil
+}
+
+// exportEnvelope is the file written by export-node-credentials. The
+// credentials are encrypted by the key derived from the passphrase by scrypt.
+type exportEnvelope struct {
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       string `json:"salt"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// ExportedCredential is an end-node in the export.
+type ExportedCredential struct {
+	VID       string `json:"vid"`
+	ThingID   string `json:"thingID"`
+	ThingType string `json:"thingType,omitempty"`
+	Password  string `json:"password"`
+}
+
+func sealExport(passphrase string, creds []ExportedCredential) ([]byte, error) {
+	plaintext, err := json.Marshal(creds)
+	if err != nil {
+		return nil, err
+	}
+	env := exportEnvelope{KDF: "scrypt", N: 1 << 15, R: 8, P: 1}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, env.N, env.R, env.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	env.Salt = base64.StdEncoding.EncodeToString(salt)
+	env.Ciphertext = base64.StdEncoding.EncodeToString(sealed)
+	return json.MarshalIndent(env, "", "  ")
+}
+
+func openExport(passphrase string, b []byte) ([]ExportedCredential, error) {
+	var env exportEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, err
+	}
+	if env.KDF != "scrypt" {
+		return nil, fmt.Errorf("unknown kdf %q", env.KDF)
+	}
+	salt, err := base64.StdEncoding.DecodeString(env.Salt)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(env.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, env.N, env.R, env.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(key, sealed)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or broken file")
+	}
+	var creds []ExportedCredential
+	err = json.Unmarshal(plaintext, &creds)
+	return creds, err
+}
+
+// nodePassword returns the password of the end-node generated by
+// --generate-password or given by readSecret. It is checked by the password
+// policy of the profile.
+func nodePassword(c *cli.Context, appName string, vid string, profile ThingTypeProfile, hasProfile bool) (string, error) {
+	var p *ThingTypeProfile
+	if hasProfile {
+		p = &profile
+	}
+	if c.Bool("generate-password") {
+		return generatePassword(p)
+	}
+	password, err := readSecret(c, "node-password", secretNode, appName, vid)
+	if err != nil {
+		return "", err
+	}
+	if p != nil {
+		if err := p.validatePassword(password); err != nil {
+			return "", err
+		}
+	}
+	return password, nil
+}
+
+var rotateNodePassword = cli.Command{
+	Name:  "rotate-node-password",
+	Usage: "rotate-node-password (--node-vid <vid> ... | --thing-type <thing type> | --all) --app-name <app name>",
+	UsageText: `Change the passwords of the end-nodes on Kii Cloud to generated ones and
+	store them encrypted in the DB. The current password is the stored one, or
+	given by --node-password when it is not stored.`,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name: "app-name",
+		},
+		userFlag,
+		cli.StringSliceFlag{
+			Name:  "node-vid",
+			Usage: "Vendor thing id of the end-node. Can be repeated",
+		},
+		cli.StringFlag{
+			Name:  "thing-type",
+			Usage: "Select the end-nodes of the thing type",
+		},
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "Select all the end-nodes of the app",
+		},
+	}, secretFlags("node-password", "current end node password when it is not stored")...),
+	Action: func(c *cli.Context) {
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		user := mustUser(c, appName)
+		selected := selectNodes(c, appName)
+		a := startAudit(c, "rotate-node-password")
+		failed := 0
+		for _, n := range selected {
+			if err := rotatePassword(c, appName, app, user, n); err != nil {
+				failed++
+				fmt.Printf("  failed %s: %v\n", n.VID, err)
+				continue
+			}
+			fmt.Printf("  done   %s\n", n.VID)
+			stepCompleted("rotate-node-password " + n.VID)
+		}
+		if failed > 0 {
+			a.Fatal(failed, " end-node(s) failed")
+		}
+		a.Done()
+	},
+}
+
+// rotatePassword changes the password of the end-node. The new password is
+// staged in the DB before it is set on Kii Cloud. When a previous rotation
+// was interrupted, its pending password is tried as the current one too.
+func rotatePassword(c *cli.Context, appName string, app App, user User, n Node) error {
+	s, err := storedNodeSecret(appName, n.VID)
+	if err != nil {
+		return err
+	}
+	var current []string
+	if s != nil {
+		for _, p := range []string{s.Password, s.Pending} {
+			if p != "" {
+				current = append(current, p)
+			}
+		}
+	}
+	if len(current) == 0 {
+		p, err := readSecret(c, "node-password", secretNode, appName, n.VID)
+		if err != nil {
+			return err
+		}
+		current = append(current, p)
+	}
+	r, err := storedNodeRecord(appName, n.VID)
+	if err != nil {
+		return err
+	}
+	var profile *ThingTypeProfile
+	if r != nil {
+		if p, ok, err := thingTypeProfile(r.ThingType); err == nil && ok {
+			profile = &p
+		}
+	}
+	password, err := generatePassword(profile)
+	if err != nil {
+		return err
+	}
+	// Keep the current password stored so that it isn't lost when it was
+	// given by the flag.
+	if err := storeNodeSecret(appName, n.VID, NodeSecret{Password: current[0], Pending: password}); err != nil {
+		return err
+	}
+	for _, old := range current {
+		// The next password is tried only when this one is rejected.
+		err = _changeThingPassword(gCtx, app, user, n.ID, old, password)
+		if !rejectedByCloud(err) {
+			break
+		}
+	}
+	if err := settleNodePassword(appName, n.VID, err); err != nil {
+		stdLog.Errorln("failed to store end node password: ", err)
+	}
+	return err
+}
+
+var exportNodeCredentials = cli.Command{
+	Name:  "export-node-credentials",
+	Usage: "export-node-credentials (--node-vid <vid> ... | --thing-type <thing type> | --all) --out <file> --app-name <app name> | export-node-credentials --decrypt <file>",
+	UsageText: `Export the stored passwords of the end-nodes for flashing them. The file is
+	encrypted by the key derived from the passphrase with scrypt and AES-GCM.
+	--decrypt prints the credentials in the file in JSON.`,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name: "app-name",
+		},
+		cli.StringSliceFlag{
+			Name:  "node-vid",
+			Usage: "Vendor thing id of the end-node. Can be repeated",
+		},
+		cli.StringFlag{
+			Name:  "thing-type",
+			Usage: "Select the end-nodes of the thing type",
+		},
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "Select all the end-nodes of the app",
+		},
+		cli.StringFlag{
+			Name:  "out",
+			Usage: "File to write the encrypted credentials",
+		},
+		cli.StringFlag{
+			Name:  "decrypt",
+			Usage: "File written by export-node-credentials to decrypt",
+		},
+	}, secretFlags("passphrase", "passphrase encrypting the file")...),
+	Action: func(c *cli.Context) {
+		if path := c.String("decrypt"); path != "" {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				stdLog.Fatalln(err)
+			}
+			passphrase, err := readSecret(c, "passphrase", secretExport, "", path)
+			if err != nil {
+				stdLog.Fatalln(err)
+			}
+			creds, err := openExport(passphrase, b)
+			if err != nil {
+				stdLog.Fatalf("can't decrypt %s: %v\n", path, err)
+			}
+			b, _ = json.MarshalIndent(creds, "", "  ")
+			fmt.Println(string(b))
+			return
+		}
+		appName := appNameOf(c)
+		mustApp(appName)
+		out := c.String("out")
+		if out == "" {
+			stdLog.Fatalln("no --out is specified")
+		}
+		var creds []ExportedCredential
+		for _, n := range selectNodes(c, appName) {
+			s, err := storedNodeSecret(appName, n.VID)
+			if err != nil {
+				stdLog.Fatalln("failed to read end node password: ", err)
+			}
+			if s == nil || s.Password == "" {
+				stdLog.Warnf("no password of %s is stored. skipped\n", n.VID)
+				continue
+			}
+			if s.Pending != "" {
+				stdLog.Warnf("rotation of the password of %s was interrupted. execute rotate-node-password --node-vid %s\n", n.VID, n.VID)
+			}
+			cred := ExportedCredential{VID: n.VID, ThingID: n.ID, Password: s.Password}
+			if r, err := storedNodeRecord(appName, n.VID); err == nil && r != nil {
+				cred.ThingType = r.ThingType
+			}
+			creds = append(creds, cred)
+		}
+		if len(creds) == 0 {
+			stdLog.Fatalln("no end node password to export")
+		}
+		passphrase, err := readSecret(c, "passphrase", secretExport, appName, out)
+		if err != nil {
+			stdLog.Fatalln(err)
+		}
+		a := startAudit(c, "export-node-credentials")
+		a.Target(out)
+		b, err := sealExport(passphrase, creds)
+		if err != nil {
+			a.Fatal("failed to encrypt credentials: ", err)
+		}
+		if err := ioutil.WriteFile(out, append(b, '\n'), 0600); err != nil {
+			a.Fatal("failed to write credentials: ", err)
+		}
+		fmt.Printf("exported %d end-node(s) to %s\n", len(creds), out)
+		a.Done()
+	},
+}
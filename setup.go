@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/codegangsta/cli"
+)
+
+// Steps to bring up a gateway.
+const (
+	stepUserLogin      = "user-login"
+	stepAuth           = "auth"
+	stepOnboardGateway = "onboard-gateway"
+	stepAddOwner       = "add-owner"
+)
+
+// setupSteps are the steps in the order to be executed.
+var setupSteps = []string{stepUserLogin, stepAuth, stepOnboardGateway, stepAddOwner}
+
+// stages maps the step to the lifecycle stage of the gateway reached by it.
+var stages = map[string]string{
+	stepUserLogin:      "logged-in",
+	stepAuth:           "authenticated",
+	stepOnboardGateway: "onboarded",
+	stepAddOwner:       "owned",
+}
+
+type StepStatus struct {
+	Done      bool      `json:"done"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// SetupStatus is the progress of setting up a gateway stored in the setup
+// bucket. The key is the same as the tokens bucket.
+type SetupStatus struct {
+	Steps map[string]StepStatus `json:"steps"`
+}
+
+// Stage returns the lifecycle stage reached by the steps done in order.
+func (s SetupStatus) Stage() string {
+	stage := "new"
+	for _, step := range setupSteps {
+		if !s.Steps[step].Done {
+			break
+		}
+		stage = stages[step]
+	}
+	return stage
+}
+
+func loadSetupStatus(tx *bolt.Tx, gwKey string) SetupStatus {
+	status := SetupStatus{Steps: map[string]StepStatus{}}
+	v := tx.Bucket([]byte("setup")).Get([]byte(gwKey))
+	if v != nil {
+		json.Unmarshal(v, &status)
+	}
+	return status
+}
+
+// recordStep stores the result of the step. A failed step is marked as not
+// done to be executed again.
+func recordStep(gwKey string, step string, stepErr error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		status := loadSetupStatus(tx, gwKey)
+		st := StepStatus{
+			Done:      stepErr == nil,
+			UpdatedAt: time.Now(),
+		}
+		if stepErr != nil {
+			st.Error = stepErr.Error()
+		}
+		status.Steps[step] = st
+		j, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("setup")).Put([]byte(gwKey), j)
+	})
+	if err != nil {
+		stdLog.Warnln("failed to store status of ", step, ": ", err)
+	}
+}
+
+var setupGateway = cli.Command{
+	Name:  "setup-gateway",
+	Usage: "setup-gateway --username <user name> --admin-username <gateway admin user name> [--master] [--from <step>] --app-name <app name>",
+	UsageText: `Execute user-login, auth, onboard-gateway and add-owner in order.
+	Steps already done are skipped, so the command can be executed again to resume after a failure.
+	Passwords are asked only for the steps to be executed.`,
+	Flags: joinFlags(
+		[]cli.Flag{
+			cli.StringFlag{
+				Name: "app-name",
+			},
+			cli.StringFlag{
+				Name:  "username",
+				Usage: "Gateway owner user name (Kii Cloud User)",
+			},
+			cli.BoolFlag{
+				Name:  "register",
+				Usage: "Register the user when the login fails",
+			},
+			cli.StringFlag{
+				Name:  "admin-username",
+				Usage: "Gateway admin user name",
+			},
+			cli.BoolFlag{
+				Name:  "master",
+				Usage: "Onboard the gateway as master gateway",
+			},
+			cli.StringFlag{
+				Name:  "from",
+				Usage: "Execute again from the step even if it is done. One of " + strings.Join(setupSteps, ", "),
+			},
+		},
+		registrationFlags,
+		secretFlags("password", "Gateway owner password (Kii Cloud User)"),
+		secretFlags("admin-password", "Gateway admin password"),
+		secretFlags("gateway-password", "Password of the gateway. It is configured in coonfig file of Gateway Agent"),
+	),
+	Action: func(c *cli.Context) {
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		gwKey := gatewayKey(c, appName)
+		addr := gatewayAddress(c)
+		from := c.String("from")
+		if from != "" && stages[from] == "" {
+			stdLog.Fatalf("unknown step %s. available steps: %s\n", from, strings.Join(setupSteps, ", "))
+		}
+
+		var status SetupStatus
+		db.View(func(tx *bolt.Tx) error {
+			status = loadSetupStatus(tx, gwKey)
+			return nil
+		})
+		redo := false
+		for _, step := range setupSteps {
+			if step == from {
+				redo = true
+			}
+			if status.Steps[step].Done && !redo {
+				stdLog.Printf("%s: already done. skipped.\n", step)
+				continue
+			}
+			stdLog.Printf("%s: executing.\n", step)
+			a := startAudit(c, step)
+			err := runSetupStep(gCtx, c, step, appName, gwKey, app, addr, a)
+			if err != nil {
+				a.Fail(err)
+				stdLog.Fatalf("setup-gateway stopped at %s: %v\nexecute setup-gateway again to resume.\n", step, err)
+			}
+			a.Done()
+			stdLog.Printf("%s: done.\n", step)
+		}
+		stdLog.Printf("gateway %s is set up. id: %s\n", gwKey, storedGatewayID(gwKey))
+	},
+}
+
+// runSetupStep executes the step. a is the audit record of the step.
+func runSetupStep(ctx context.Context, c *cli.Context, step string, appName string, gwKey string, app App, addr GatewayAddress, a *auditor) error {
+	switch step {
+	case stepUserLogin:
+		username := c.String("username")
+		if username == "" {
+			return fmt.Errorf("no username is specified")
+		}
+		a.Target(username)
+		password, err := readSecret(c, "password", secretKiiUser, appName, username)
+		if err != nil {
+			return err
+		}
+		var reg *UserRegistration
+		if c.Bool("register") {
+			r := registrationOf(c, username)
+			reg = &r
+		}
+		user, err := doUserLogin(ctx, appName, gwKey, app, username, password, reg)
+		a.ID("userID", user.ID)
+		return err
+	case stepAuth:
+		username := c.String("admin-username")
+		if username == "" {
+			return fmt.Errorf("no admin-username is specified")
+		}
+		a.Target(username)
+		password, err := readSecret(c, "admin-password", secretGatewayAdmin, appName, username)
+		if err != nil {
+			return err
+		}
+		return doAuth(ctx, addr, gwKey, app, username, password)
+	case stepOnboardGateway:
+		a.Target(fmt.Sprintf("%s:%d", addr.Host, addr.Port))
+		id, err := doOnboardGateway(ctx, addr, gwKey, app, c.Bool("master"))
+		a.ID("gatewayID", id)
+		return err
+	case stepAddOwner:
+		id := storedGatewayID(gwKey)
+		a.Target(id)
+		password, err := readSecret(c, "gateway-password", secretGatewayThing, appName, id)
+		if err != nil {
+			return err
+		}
+		// The owner is the user of --username, or the resolved user when
+		// user-login was done by an earlier execution.
+		username := c.String("username")
+		if username == "" {
+			username, _ = resolveUser(c, appName)
+		}
+		user, err := storedUser(appName, username)
+		if err != nil {
+			return err
+		}
+		return doAddOwner(ctx, gwKey, app, user, password)
+	}
+	return fmt.Errorf("unknown step %s", step)
+}
+
+var statusCommand = cli.Command{
+	Name:      "status",
+	Usage:     "status",
+	UsageText: "Show the lifecycle stage of each gateway and the status of each setup step.",
+	Action: func(c *cli.Context) {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "APP\tGATEWAY\tSTAGE\tGATEWAY ID\tSTEPS")
+		db.View(func(tx *bolt.Tx) error {
+			for _, key := range gatewayKeys(tx) {
+				s := loadSetupStatus(tx, key)
+				if len(s.Steps) == 0 {
+					s = inferSetupStatus(tx, key)
+				}
+				appName, gatewayName := splitGatewayKey(key)
+				id := string(tx.Bucket([]byte("gateway-ids")).Get([]byte(key)))
+				var steps []string
+				for _, step := range setupSteps {
+					steps = append(steps, step+":"+stepLabel(s.Steps[step]))
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", appName, gatewayName, s.Stage(), id, strings.Join(steps, " "))
+			}
+			return nil
+		})
+		w.Flush()
+	},
+}
+
+func stepLabel(st StepStatus) string {
+	switch {
+	case st.Done && st.UpdatedAt.IsZero():
+		return "done"
+	case st.Done:
+		return "done(" + st.UpdatedAt.Format(time.RFC3339) + ")"
+	case st.Error != "":
+		return "failed(" + st.Error + ")"
+	}
+	return "-"
+}
+
+// gatewayKeys returns the keys of gateways known to the DB.
+func gatewayKeys(tx *bolt.Tx) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, name := range []string{"setup", "tokens", "gateway-ids"} {
+		tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+			if !seen[string(k)] {
+				seen[string(k)] = true
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+	}
+	return keys
+}
+
+// inferSetupStatus guesses the status from the stored entries for gateways
+// set up before the progress is recorded. add-owner leaves nothing in the DB
+// so it is never inferred as done.
+func inferSetupStatus(tx *bolt.Tx, gwKey string) SetupStatus {
+	appName, _ := splitGatewayKey(gwKey)
+	s := SetupStatus{Steps: map[string]StepStatus{}}
+	users, _ := getUsers(tx, appName)
+	s.Steps[stepUserLogin] = StepStatus{Done: len(users) > 0}
+	s.Steps[stepAuth] = StepStatus{Done: tx.Bucket([]byte("tokens")).Get([]byte(gwKey)) != nil}
+	s.Steps[stepOnboardGateway] = StepStatus{Done: tx.Bucket([]byte("gateway-ids")).Get([]byte(gwKey)) != nil}
+	return s
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/peterh/liner"
+)
+
+// inShell is true while the shell runs commands. The config, the DB and the
+// HTTP transports set up when the shell started are shared by them.
+var inShell bool
+
+// shellExit is panicked by stdLog.Fatal in the shell to end the command
+// instead of the process.
+type shellExit int
+
+// shellFixedFlags are the global flags applied when the shell starts. They are
+// rejected on the lines of the shell instead of being ignored.
+var shellFixedFlags = []string{"dry-run", "record", "replay", "trace-file", "timeout", "log-level", "log-format", "log-file", "metrics-addr"}
+
+// fixedFlagOf returns the flag of shellFixedFlags given before the command in
+// words, empty when none is given.
+func fixedFlagOf(app *cli.App, words []string) string {
+	for _, w := range words {
+		if app.Command(w) != nil {
+			return ""
+		}
+		if !strings.HasPrefix(w, "-") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimLeft(w, "-"), "=", 2)[0]
+		for _, f := range shellFixedFlags {
+			if name == f {
+				return "--" + name
+			}
+		}
+	}
+	return ""
+}
+
+// shellSession is the app, the gateway and the user set by the set command of
+// the shell. They are given to every command as global --app-name, --gateway
+// and --user.
+type shellSession struct {
+	app     string
+	gateway string
+	user    string
+}
+
+var shellCommand = cli.Command{
+	Name:  "shell",
+	Usage: "shell",
+	UsageText: `Interactive prompt accepting the commands of the CLI. The config, the DB and
+	HTTP connections are kept open. Built-in commands:
+	set app <app name>      - use the app in the session
+	set gateway <gateway>   - use the gateway in the session
+	set user <user name>    - use the user stored by user-login in the session
+	set                     - show the app, the gateway and the user of the session
+	exit                    - leave the shell
+	Global flags such as --dry-run, --trace-file, --timeout and --log-level are given when the shell starts.`,
+	Action: func(c *cli.Context) {
+		if inShell {
+			stdLog.Errorln("already in the shell")
+			return
+		}
+		inShell = true
+		exitFunc := stdLog.ExitFunc
+		stdLog.ExitFunc = func(code int) { panic(shellExit(code)) }
+		defer func() {
+			inShell = false
+			stdLog.ExitFunc = exitFunc
+		}()
+
+		line := liner.NewLiner()
+		defer line.Close()
+		line.SetCtrlCAborts(true)
+		line.SetWordCompleter(func(l string, pos int) (string, []string, string) {
+			return completeLine(c.App, l, pos)
+		})
+		historyFile := shellHistoryFile()
+		if f, err := os.Open(historyFile); err == nil {
+			line.ReadHistory(f)
+			f.Close()
+		}
+		defer func() {
+			if f, err := os.OpenFile(historyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err == nil {
+				line.WriteHistory(f)
+				f.Close()
+			}
+		}()
+
+		session := shellSession{app: c.GlobalString("app-name"), gateway: c.GlobalString("gateway"), user: c.GlobalString("user")}
+		timeout := c.GlobalDuration("timeout")
+		for {
+			l, err := line.Prompt(session.prompt())
+			if err == liner.ErrPromptAborted {
+				continue
+			}
+			if err == io.EOF {
+				fmt.Println()
+				return
+			}
+			if err != nil {
+				stdLog.Errorln("can't read the line: ", err)
+				return
+			}
+			words, err := splitWords(l)
+			if err != nil {
+				stdLog.Errorln(err)
+				continue
+			}
+			if len(words) == 0 {
+				continue
+			}
+			if !hasSecret(words) {
+				line.AppendHistory(l)
+			}
+			switch words[0] {
+			case "exit", "quit":
+				return
+			case "set":
+				runShellLine(func() { session.set(words[1:]) })
+				continue
+			case "shell":
+				stdLog.Errorln("already in the shell")
+				continue
+			}
+			if f := fixedFlagOf(c.App, words); f != "" {
+				stdLog.Errorf("%s can't be given in the shell. give it before shell when the shell starts\n", f)
+				continue
+			}
+			args := []string{c.App.Name}
+			if session.app != "" {
+				args = append(args, "--app-name", session.app)
+			}
+			if session.gateway != "" {
+				args = append(args, "--gateway", session.gateway)
+			}
+			if session.user != "" {
+				args = append(args, "--user", session.user)
+			}
+			args = append(args, words...)
+			runShellLine(func() {
+				stop := startLineCancellation(timeout)
+				defer stop()
+				if err := c.App.Run(args); err != nil {
+					stdLog.Errorln(err)
+				}
+			})
+		}
+	},
+}
+
+// runShellLine runs f, recovering from stdLog.Fatal so that the shell goes
+// on.
+func runShellLine(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(shellExit); !ok {
+				panic(r)
+			}
+		}
+	}()
+	f()
+}
+
+func (s *shellSession) set(args []string) {
+	switch {
+	case len(args) == 0:
+		fmt.Printf("app: %s\ngateway: %s\nuser: %s\n", orDash(s.app), orDash(s.gateway), orDash(s.user))
+	case args[0] == "app" && len(args) == 2:
+		mustApp(args[1])
+		s.app = args[1]
+	case args[0] == "gateway" && len(args) == 2:
+		mustGateway(args[1])
+		s.gateway = args[1]
+	case args[0] == "user" && len(args) == 2:
+		app := s.app
+		if app == "" {
+			app = getContext(contextApp)
+		}
+		if _, err := storedUser(app, args[1]); err != nil {
+			stdLog.Errorln(err)
+			return
+		}
+		s.user = args[1]
+	default:
+		stdLog.Errorln("usage: set [app <app name> | gateway <gateway name> | user <user name>]")
+	}
+}
+
+func (s shellSession) prompt() string {
+	if s.app == "" && s.gateway == "" {
+		return "gwm> "
+	}
+	return fmt.Sprintf("gwm[%s@%s]> ", orDash(s.app), orDash(s.gateway))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func shellHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".gwm_history"
+	}
+	return filepath.Join(home, ".gwm_history")
+}
+
+// hasSecret tells whether the words give a password by a flag. Such lines
+// are kept out of the history.
+func hasSecret(words []string) bool {
+	for _, w := range words {
+		name := strings.SplitN(strings.TrimLeft(w, "-"), "=", 2)[0]
+		if strings.HasPrefix(w, "-") && secretFlagNames[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// completeLine completes the word at pos of the line by completions.
+func completeLine(app *cli.App, l string, pos int) (head string, candidates []string, tail string) {
+	words, err := splitWords(l[:pos])
+	if err != nil {
+		return l[:pos], nil, l[pos:]
+	}
+	cur := ""
+	if len(words) > 0 && !strings.HasSuffix(l[:pos], " ") {
+		cur = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+	all := completions(app, append(words, cur))
+	if len(words) == 0 {
+		all = append(all, "set", "exit")
+	}
+	for _, s := range all {
+		if strings.HasPrefix(s, cur) {
+			candidates = append(candidates, s+" ")
+		}
+	}
+	return l[:pos-len(cur)], candidates, l[pos:]
+}
+
+// splitWords splits the line into words like a shell. Single and double
+// quotes and backslash escapes are handled.
+func splitWords(l string) ([]string, error) {
+	var words []string
+	var word []rune
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range l {
+		switch {
+		case escaped:
+			word = append(word, r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word = append(word, r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, string(word))
+				word, inWord = nil, false
+			}
+		default:
+			word = append(word, r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
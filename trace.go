@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HAR 1.2 types. Only the fields filled by harTransport are defined.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	// Error is the error of the transport, e.g. connection refused.
+	Error string `json:"_error,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// secretHeaders are redacted in the trace.
+var secretHeaders = map[string]bool{
+	"Authorization": true,
+	"X-Kii-Appkey":  true,
+	"Cookie":        true,
+	"Set-Cookie":    true,
+}
+
+// harTransport captures requests and responses of next into a HAR file with
+// secrets redacted. The file is written after every request so that it is
+// left even when the command exits by a fatal error.
+type harTransport struct {
+	next http.RoundTripper
+	path string
+
+	mu  sync.Mutex
+	har HAR
+}
+
+func newHARTransport(next http.RoundTripper, path string, version string) *harTransport {
+	t := &harTransport{next: next, path: path}
+	t.har.Log = HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "gw-manager", Version: version},
+		Entries: []HAREntry{},
+	}
+	return t
+}
+
+func (t *harTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	e := HAREntry{
+		StartedDateTime: time.Now(),
+		Request: HARRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Headers:     harHeaders(req.Header),
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(reqBody),
+		},
+	}
+	if e.Request.HTTPVersion == "" {
+		e.Request.HTTPVersion = "HTTP/1.1"
+	}
+	for name, values := range req.URL.Query() {
+		for _, v := range values {
+			e.Request.QueryString = append(e.Request.QueryString, HARNameValue{Name: name, Value: v})
+		}
+	}
+	if reqBody != nil {
+		e.Request.PostData = &HARPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     redactBody(reqBody),
+		}
+	}
+
+	res, err := t.next.RoundTrip(req)
+	wait := time.Since(e.StartedDateTime)
+	e.Response = HARResponse{
+		Headers:     []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		resBody, rerr := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(bytes.NewReader(resBody))
+		if rerr != nil {
+			e.Error = rerr.Error()
+		}
+		e.Response.Status = res.StatusCode
+		e.Response.StatusText = http.StatusText(res.StatusCode)
+		e.Response.HTTPVersion = res.Proto
+		e.Response.Headers = harHeaders(res.Header)
+		e.Response.RedirectURL = res.Header.Get("Location")
+		e.Response.BodySize = len(resBody)
+		e.Response.Content = HARContent{
+			Size:     len(resBody),
+			MimeType: res.Header.Get("Content-Type"),
+			Text:     redactBody(resBody),
+		}
+	}
+	total := time.Since(e.StartedDateTime)
+	e.Time = ms(total)
+	e.Timings = HARTimings{Wait: ms(wait), Receive: ms(total - wait)}
+	t.add(e)
+	return res, err
+}
+
+func (t *harTransport) add(e HAREntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.har.Log.Entries = append(t.har.Log.Entries, e)
+	b, err := json.MarshalIndent(t.har, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(t.path, b, 0600)
+	}
+	if err != nil {
+		stdLog.Warnln("failed to write trace file: ", err)
+	}
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := []HARNameValue{}
+	for _, name := range names {
+		for _, v := range h[name] {
+			if secretHeaders[http.CanonicalHeaderKey(name)] {
+				v = redacted
+			}
+			headers = append(headers, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return headers
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+)
+
+// UserRegistration is the Kii user registered by user-register and
+// user-login --register.
+type UserRegistration struct {
+	LoginName    string `json:"loginName"`
+	DisplayName  string `json:"displayName,omitempty"`
+	EmailAddress string `json:"emailAddress,omitempty"`
+	PhoneNumber  string `json:"phoneNumber,omitempty"`
+}
+
+// registrationFlags give the attributes of the user registered.
+var registrationFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "email",
+		Usage: "Email address of the user registered",
+	},
+	cli.StringFlag{
+		Name:  "phone",
+		Usage: "Phone number of the user registered in international format, e.g. +819012345678",
+	},
+	cli.StringFlag{
+		Name:  "display-name",
+		Usage: "Display name of the user registered",
+	},
+}
+
+func registrationOf(c *cli.Context, username string) UserRegistration {
+	return UserRegistration{
+		LoginName:    username,
+		DisplayName:  c.String("display-name"),
+		EmailAddress: c.String("email"),
+		PhoneNumber:  c.String("phone"),
+	}
+}
+
+var userRegister = cli.Command{
+	Name:      "user-register",
+	Usage:     "user-register --username <user name> [--email <email>] [--phone <phone>] [--login] --app-name <app name>",
+	UsageText: "Register a Kii Cloud User. It fails when the user name, the email or the phone is taken.",
+	Flags: joinFlags(
+		[]cli.Flag{
+			cli.StringFlag{
+				Name:  "username",
+				Usage: "User name (Kii Cloud User)",
+			},
+			cli.StringFlag{
+				Name: "app-name",
+			},
+			cli.BoolFlag{
+				Name:  "login",
+				Usage: "Login with the user after the registration, as user-login",
+			},
+		},
+		registrationFlags,
+		secretFlags("password", "Password of the user (Kii Cloud User)"),
+	),
+	Action: func(c *cli.Context) {
+		username := c.String("username")
+		appName := appNameOf(c)
+		app := mustApp(appName)
+		if username == "" {
+			stdLog.Fatalln("no username is specified")
+		}
+		password, err := readSecret(c, "password", secretKiiUser, appName, username)
+		if err != nil {
+			stdLog.Fatalln(err)
+		}
+		a := startAudit(c, "user-register")
+		a.Target(username)
+		id, err := _registerUser(gCtx, app, registrationOf(c, username), password)
+		if err != nil {
+			a.Fatal("failed to register the user: ", err)
+		}
+		a.ID("userID", id)
+		fmt.Printf("registered %s. id: %s\n", username, id)
+		if c.Bool("login") {
+			if _, err := doUserLogin(gCtx, appName, gatewayKey(c, appName), app, username, password, nil); err != nil {
+				a.Fatal(err)
+			}
+		}
+		a.Done()
+	},
+}
+
+// loginOrRegister logins as the user. When the login fails and reg is given,
+// the user is registered and logged in.
+func loginOrRegister(ctx context.Context, app App, username string, password string, reg *UserRegistration) (id string, token string, err error) {
+	id, token, err = _userLogin(ctx, app, username, password)
+	if err == nil {
+		return id, token, nil
+	}
+	if reg == nil {
+		return "", "", fmt.Errorf("failed to login with the user: %v. check the username and the password, or register the user by user-register or --register", err)
+	}
+	stdLog.Infof("login failed. registering %s\n", username)
+	if _, err := _registerUser(ctx, app, *reg, password); err != nil {
+		if e, ok := err.(*UserConflictError); ok && (e.Field == "" || e.Field == "loginName") {
+			return "", "", fmt.Errorf("user %s exists but the login failed. check the password", username)
+		}
+		return "", "", fmt.Errorf("failed to register the user: %v", err)
+	}
+	id, token, err = _userLogin(ctx, app, username, password)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to login with the user registered: %v", err)
+	}
+	return id, token, nil
+}
+
+// userFlag selects the user stored by user-login for commands calling Kii
+// Cloud.
+var userFlag = cli.StringFlag{
+	Name:  "user",
+	Usage: "User name stored by user-login. The current user of the app when not given",
+}
+
+var userCommand = cli.Command{
+	Name:  "user",
+	Usage: "user list|use|logout",
+	UsageText: `Manage the users stored by user-login. Commands calling Kii Cloud act as the
+	user given by --user, GWM_USER, the current user set by user use or
+	user-login, or the only user of the app in this order.`,
+	Subcommands: []cli.Command{
+		{
+			Name:      "list",
+			Usage:     "list --app-name <app name>",
+			UsageText: "List the users of the app. The current user is marked with *.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "app-name",
+				},
+			},
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				mustApp(appName)
+				users, err := storedUsers(appName)
+				if err != nil {
+					stdLog.Fatalln("failed to read users from db: ", err)
+				}
+				current, _ := resolveUser(c, appName)
+				var names []string
+				for name := range users {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "CURRENT\tUSERNAME\tUSER ID")
+				for _, name := range names {
+					mark := ""
+					if name == current || len(users) == 1 && current == "" {
+						mark = "*"
+					}
+					display := name
+					if name == "" {
+						display = "(stored by an older version)"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\n", mark, display, users[name].ID)
+				}
+				w.Flush()
+			},
+		},
+		{
+			Name:      "use",
+			Usage:     "use <user name> --app-name <app name>",
+			UsageText: "Make the user the current user of the app.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "app-name",
+				},
+			},
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				mustApp(appName)
+				name := c.Args().First()
+				if name == "" {
+					stdLog.Fatalln("no user name is specified")
+				}
+				if _, err := storedUser(appName, name); err != nil {
+					stdLog.Fatalln(err)
+				}
+				if err := setContext(contextUser+appName, name); err != nil {
+					stdLog.Fatalln("failed to store context: ", err)
+				}
+			},
+		},
+		{
+			Name:      "logout",
+			Usage:     "logout [<user name>] --app-name <app name>",
+			UsageText: "Revoke the token of the user on Kii Cloud and remove the user from the DB. The resolved user when no user name is given.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "app-name",
+				},
+				userFlag,
+			},
+			Action: func(c *cli.Context) {
+				appName := appNameOf(c)
+				app := mustApp(appName)
+				name := c.Args().First()
+				if name == "" {
+					name, _ = resolveUser(c, appName)
+				}
+				user, err := storedUser(appName, name)
+				if err != nil {
+					stdLog.Fatalln(err)
+				}
+				a := startAudit(c, "user-logout")
+				a.Target(user.Username)
+				a.ID("userID", user.ID)
+				revokeErr := _revokeToken(gCtx, app, user.Token)
+				// The token is purged even when the revocation fails so that
+				// it is not used any more.
+				if err := deleteUser(appName, user.Username); err != nil {
+					a.Fatal("failed to remove the user from db: ", err)
+				}
+				if getContext(contextUser+appName) == user.Username {
+					if err := setContext(contextUser+appName, ""); err != nil {
+						stdLog.Errorln("failed to store context: ", err)
+					}
+				}
+				if revokeErr != nil {
+					a.Fatal("the token is removed from db but failed to revoke it: ", revokeErr)
+				}
+				a.Done()
+			},
+		},
+	},
+}
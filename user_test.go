@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/cli"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// TestRegistrationBody checks every registration flag of the commands
+// registering users reaches the request body.
+func TestRegistrationBody(t *testing.T) {
+	var body map[string]string
+	defer func(t http.RoundTripper) { http.DefaultTransport = t }(http.DefaultTransport)
+	http.DefaultTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &body); err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: 201,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"userID":"uid-owner"}`)),
+			Request:    req,
+		}, nil
+	})
+
+	for _, cmd := range []cli.Command{userLogin, userRegister, setupGateway} {
+		set := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+		for _, f := range cmd.Flags {
+			f.Apply(set)
+		}
+		err := set.Parse([]string{"--email", "owner@example.com", "--phone", "+819012345678", "--display-name", "Owner"})
+		if err != nil {
+			t.Fatalf("%s: %v", cmd.Name, err)
+		}
+		c := cli.NewContext(nil, set, nil)
+		body = nil
+		id, err := _registerUser(context.Background(), App{ID: "app1", Host: "api.example.com"}, registrationOf(c, "owner"), "secret")
+		if err != nil {
+			t.Fatalf("%s: %v", cmd.Name, err)
+		}
+		if id != "uid-owner" {
+			t.Errorf("%s: id = %q", cmd.Name, id)
+		}
+		want := map[string]string{
+			"loginName":    "owner",
+			"emailAddress": "owner@example.com",
+			"phoneNumber":  "+819012345678",
+			"displayName":  "Owner",
+			"password":     "secret",
+		}
+		if !reflect.DeepEqual(body, want) {
+			t.Errorf("%s: body = %v, want %v", cmd.Name, body, want)
+		}
+	}
+}